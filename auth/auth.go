@@ -4,6 +4,8 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/nuric/go-web-app-template/models"
@@ -14,13 +16,18 @@ type contextKey string
 
 const sessionName = "app-session"
 const userKey contextKey = "currentUser"
+const apiTokenKey contextKey = "apiToken"
 const userIDKey = "userId"
 
+// APITokenPurpose marks the models.Token rows that authenticate requests with
+// an Authorization: Bearer header instead of a session.
+const APITokenPurpose = "api"
+
 func UserMiddleware(next http.Handler, db *gorm.DB, store sessions.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s, err := store.Get(r, sessionName)
 		if err != nil {
-			slog.Error("Failed to get session", "error", err)
+			slog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -31,21 +38,67 @@ func UserMiddleware(next http.Handler, db *gorm.DB, store sessions.Store) http.H
 		if userId, ok := s.Values[userIDKey].(uint); ok {
 			// Fetch user from database to ensure user exists
 			var user models.User
-			if err := db.First(&user, userId).Error; err != nil && err != gorm.ErrRecordNotFound {
-				slog.Error("Failed to fetch user from database", "error", err)
+			if err := db.WithContext(r.Context()).First(&user, userId).Error; err != nil && err != gorm.ErrRecordNotFound {
+				slog.ErrorContext(r.Context(), "Failed to fetch user from database", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			// Locked users are treated as logged out so existing sessions,
+			// possibly an attacker's, stop working immediately.
+			if user.Locked {
+				slog.DebugContext(r.Context(), "Ignoring session of locked user", "userId", user.ID)
+			} else {
+				// Store user ID in request context for further use
+				ctx := r.Context()
+				ctx = context.WithValue(ctx, userKey, user)
+				r = r.WithContext(ctx)
+			}
+		}
+		// Without a session clients may send an API token instead
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && GetCurrentUser(r).ID == 0 {
+			var err error
+			if r, err = withAPIToken(r, db, strings.TrimSpace(bearer)); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to check API token", "error", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			// Store user ID in request context for further use
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, userKey, user)
-			r = r.WithContext(ctx)
 		}
 		// Call the next handler
 		next.ServeHTTP(w, r)
 	})
 }
 
+// withAPIToken logs the owner of a valid API token in for this request only.
+// Unknown and expired tokens leave the request as it is.
+func withAPIToken(r *http.Request, db *gorm.DB, value string) (*http.Request, error) {
+	if value == "" {
+		return r, nil
+	}
+	var token models.Token
+	err := db.WithContext(r.Context()).
+		Where("token = ? AND purpose = ? AND expires_at > ?", value, APITokenPurpose, time.Now()).
+		Take(&token).Error
+	if err == gorm.ErrRecordNotFound {
+		slog.DebugContext(r.Context(), "Ignoring unknown API token")
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	var user models.User
+	if err := db.WithContext(r.Context()).First(&user, token.UserID).Error; err == gorm.ErrRecordNotFound {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	if user.Locked {
+		slog.DebugContext(r.Context(), "Ignoring API token of locked user", "userId", user.ID)
+		return r, nil
+	}
+	ctx := context.WithValue(r.Context(), userKey, user)
+	ctx = context.WithValue(ctx, apiTokenKey, token.ID)
+	return r.WithContext(ctx), nil
+}
+
 func AuthenticatedOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := GetCurrentUser(r)
@@ -68,6 +121,17 @@ func VerifiedOnly(next http.Handler) http.Handler {
 	})
 }
 
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := GetCurrentUser(r)
+		if user.Role != "admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func GetCurrentUser(r *http.Request) models.User {
 	user, ok := r.Context().Value(userKey).(models.User)
 	if !ok {
@@ -76,32 +140,39 @@ func GetCurrentUser(r *http.Request) models.User {
 	return user
 }
 
+// GetAPIToken returns the ID of the API token the request was authenticated
+// with, 0 for sessions and guests.
+func GetAPIToken(r *http.Request) uint {
+	id, _ := r.Context().Value(apiTokenKey).(uint)
+	return id
+}
+
 func LogUserIn(w http.ResponseWriter, r *http.Request, userId uint, store sessions.Store) error {
 	s, err := store.New(r, sessionName)
 	if err != nil {
-		slog.Error("Failed to create session", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to create session", "error", err)
 		return err
 	}
 	s.Values[userIDKey] = userId
 	if err := s.Save(r, w); err != nil {
-		slog.Error("Failed to save session", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to save session", "error", err)
 		return err
 	}
-	slog.Debug("User logged in", "userId", userId)
+	slog.DebugContext(r.Context(), "User logged in", "userId", userId)
 	return nil
 }
 
 func LogUserOut(w http.ResponseWriter, r *http.Request, store sessions.Store) error {
 	s, err := store.Get(r, sessionName)
 	if err != nil {
-		slog.Error("Failed to get session", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 		return err
 	}
 	s.Values = make(map[any]any) // Clear session values
 	if err := s.Save(r, w); err != nil {
-		slog.Error("Failed to save session", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to save session", "error", err)
 		return err
 	}
-	slog.Debug("User logged out")
+	slog.DebugContext(r.Context(), "User logged out")
 	return nil
 }
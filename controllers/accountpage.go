@@ -1,26 +1,39 @@
 package controllers
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"path/filepath"
 
 	"github.com/google/uuid"
 	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/images"
 	"github.com/nuric/go-web-app-template/models"
 	"github.com/nuric/go-web-app-template/utils"
 	"gorm.io/gorm"
 )
 
+// Profile pictures are stored at these square sizes, largest first
+var profilePictureSizes = []int{512, 128, 64}
+
+const maxPictureSize = 5 * 1024 * 1024
+
 type AccountPage struct {
 	BasePage
 	User               models.User
 	ChangeEmailForm    ChangeEmailForm
 	ChangePasswordForm ChangePasswordForm
 	UpdateProfileForm  UpdateProfileForm
+	ForgetDeviceForm   ForgetDeviceForm
+	Devices            []models.KnownDevice
+	// ID of the known device matching this request, if any
+	CurrentDeviceID uint
+	// Bytes stored by the user and their quota, 0 meaning unlimited
+	StorageUsed  int64
+	StorageQuota int64
 }
 
 type ChangeEmailForm struct {
@@ -73,8 +86,35 @@ func (f *UpdateProfileForm) Validate() bool {
 	return f.NameError == nil
 }
 
+type ForgetDeviceForm struct {
+	DeviceID uint `schema:"deviceId"`
+	Error    error
+}
+
+func (f *ForgetDeviceForm) Validate() bool {
+	if f.DeviceID == 0 {
+		f.Error = errors.New("please select a device")
+	}
+	return f.Error == nil
+}
+
 func (p *AccountPage) Handle(w http.ResponseWriter, r *http.Request) {
 	p.User = auth.GetCurrentUser(r)
+	if err := db.WithContext(r.Context()).Where("user_id = ?", p.User.ID).Order("last_seen_at DESC").Find(&p.Devices).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not load known devices", "error", err)
+	}
+	current := currentDevice(r)
+	for _, d := range p.Devices {
+		if current.matches(d) {
+			p.CurrentDeviceID = d.ID
+		}
+	}
+	p.StorageQuota = storageQuota(p.User)
+	used, err := storageUsage(db.WithContext(r.Context()), p.User.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "could not load storage usage", "error", err)
+	}
+	p.StorageUsed = used
 	// ---------------------------
 	if r.Method == http.MethodGet {
 		return
@@ -93,29 +133,76 @@ func (p *AccountPage) Handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer file.Close()
-		if handler.Size > 5*1024*1024 {
+		if handler.Size > maxPictureSize {
+			f.PictureError = errors.New("picture size exceeds 5MB limit")
+			return
+		}
+		// The header size comes from the client so we limit the read as well
+		data, err := io.ReadAll(io.LimitReader(file, maxPictureSize+1))
+		uploadBytes.Add(float64(len(data)), "profile_picture")
+		if err != nil || len(data) > maxPictureSize {
 			f.PictureError = errors.New("picture size exceeds 5MB limit")
 			return
 		}
-		// We are using a UUID for the filename to avoid collisions
+		err = scanUpload(r.Context(), p.User.ID, "profile picture "+handler.Filename, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if errors.Is(err, ErrInfected) || errors.Is(err, ErrTooLargeToScan) {
+			f.PictureError = err
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "could not scan profile picture", "error", err)
+			f.PictureError = errors.New("could not check the picture, please try again later")
+			return
+		}
+		thumbs, err := images.Thumbnails(data, profilePictureSizes...)
+		if err != nil {
+			f.PictureError = errors.New("picture must be a JPEG, PNG, GIF or WebP image up to 8192x8192 pixels")
+			return
+		}
+		var total int64
+		for _, thumb := range thumbs {
+			total += int64(len(thumb.Data))
+		}
+		// We are using a UUID for the filename to avoid collisions, each size
+		// is stored as profile/<uuid>_<size>.<ext>
 		guid := uuid.New().String()
-		fname := fmt.Sprintf("profile/%s%s", guid, filepath.Ext(handler.Filename))
-		err = db.Transaction(func(tx *gorm.DB) error {
-			if err := tx.Model(&p.User).Updates(models.User{Name: f.Name, Picture: "/uploads/" + fname}).Error; err != nil {
+		names := make([]string, len(thumbs))
+		for i, thumb := range thumbs {
+			names[i] = fmt.Sprintf("profile/%s_%d%s", guid, thumb.Size, thumb.Ext)
+		}
+		err = db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := checkQuota(tx, p.User, total); err != nil {
 				return err
 			}
-			picFile, err := st.Create(fname)
-			if err != nil {
+			// The first and largest size is the one we display
+			if err := tx.Model(&p.User).Updates(models.User{Name: f.Name, Picture: "/uploads/" + names[0]}).Error; err != nil {
 				return err
 			}
-			defer picFile.Close()
-			if _, err := io.Copy(picFile, file); err != nil {
-				return err
+			for i, thumb := range thumbs {
+				upload := models.Upload{
+					Path:        names[i],
+					OwnerID:     p.User.ID,
+					Visibility:  models.VisibilityPrivate,
+					ContentType: thumb.ContentType,
+					Size:        int64(len(thumb.Data)),
+					Group:       guid,
+				}
+				if err := tx.Create(&upload).Error; err != nil {
+					return err
+				}
+				if err := storer(r.Context()).WriteFile(names[i], thumb.Data); err != nil {
+					return err
+				}
 			}
 			return nil
 		})
+		if errors.Is(err, ErrQuotaExceeded) {
+			f.PictureError = err
+			return
+		}
 		if err != nil {
-			slog.Error("could not update user profile", "error", err)
+			slog.ErrorContext(r.Context(), "could not update user profile", "error", err)
 			f.Error = errors.New("could not update user profile")
 			return
 		}
@@ -127,7 +214,7 @@ func (p *AccountPage) Handle(w http.ResponseWriter, r *http.Request) {
 			f.Error = err
 			return
 		}
-		if err := sendEmailVerification(p.User.ID, f.Email); err != nil {
+		if err := sendEmailVerification(r.Context(), p.User.ID, f.Email); err != nil {
 			f.Error = err
 			return
 		}
@@ -140,16 +227,22 @@ func (p *AccountPage) Handle(w http.ResponseWriter, r *http.Request) {
 			f.Error = err
 			return
 		}
-		if err := checkEmailVerification(p.User.ID, f.Email, f.Token); err != nil {
+		if err := checkEmailVerification(r.Context(), p.User.ID, f.Email, f.Token); err != nil {
 			f.Error = err
 			return
 		}
 		// Update the email of the user
-		if err := db.Model(&p.User).Update("email", f.Email).Error; err != nil {
-			slog.Error("could not update user email", "error", err)
+		oldEmail := p.User.Email
+		if err := db.WithContext(r.Context()).Model(&p.User).Update("email", f.Email).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not update user email", "error", err)
 			f.Error = errors.New("could not change user email")
 			return
 		}
+		// The change itself succeeded, so we only log if the old address
+		// cannot be notified.
+		if err := sendEmailChangeNotice(r.Context(), p.User.ID, oldEmail, f.Email); err != nil {
+			slog.ErrorContext(r.Context(), "could not notify previous email address", "error", err, "userId", p.User.ID)
+		}
 		p.Flash(r, FlashSuccess, "Your email has been changed")
 		p.redirect = r.URL.Path
 	case "change_password":
@@ -163,14 +256,28 @@ func (p *AccountPage) Handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		hashedPassword := utils.HashPassword(f.NewPassword)
-		if err := db.Model(&p.User).Update("password", hashedPassword).Error; err != nil {
-			slog.Error("could not change user password", "error", err)
+		if err := db.WithContext(r.Context()).Model(&p.User).Update("password", hashedPassword).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not change user password", "error", err)
 			f.Error = errors.New("could not change user password")
 			return
 		}
 		// Redirect to GET current page
 		p.Flash(r, FlashSuccess, "Your password has been changed")
 		p.redirect = r.URL.Path
+	case "forget_device":
+		f := &p.ForgetDeviceForm
+		if err := DecodeValidForm(f, r); err != nil {
+			f.Error = err
+			return
+		}
+		// Forgotten devices trigger an alert again on the next login
+		if err := db.WithContext(r.Context()).Unscoped().Where("user_id = ?", p.User.ID).Delete(&models.KnownDevice{}, f.DeviceID).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not forget device", "error", err)
+			f.Error = errors.New("could not forget device")
+			return
+		}
+		p.Flash(r, FlashSuccess, "The device has been forgotten")
+		p.redirect = r.URL.Path
 	default:
 		p.notFound = true
 	}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/models"
+)
+
+type AdminUsersPage struct {
+	BasePage
+	User  models.User
+	Users []AdminUserRow
+	Error error
+}
+
+type AdminUserRow struct {
+	models.User
+	// Nil if the email address is not suppressed
+	Suppression *models.Suppression
+}
+
+func (p *AdminUsersPage) Handle(w http.ResponseWriter, r *http.Request) {
+	p.User = auth.GetCurrentUser(r)
+	// ---------------------------
+	if r.Method == http.MethodPost {
+		switch r.PostFormValue("_action") {
+		case "remove_suppression":
+			addr := email.NormaliseAddress(r.PostFormValue("email"))
+			// Unscoped so the address can be suppressed again later
+			if err := db.WithContext(r.Context()).Unscoped().Where("email = ?", addr).Delete(&models.Suppression{}).Error; err != nil {
+				slog.ErrorContext(r.Context(), "could not remove suppression", "error", err)
+				p.Error = errors.New("could not remove suppression")
+				return
+			}
+			p.Flash(r, FlashSuccess, "Suppression removed for "+addr)
+			p.redirect = r.URL.Path
+			return
+		default:
+			p.notFound = true
+			return
+		}
+	}
+	// ---------------------------
+	var users []models.User
+	if err := db.WithContext(r.Context()).Order("created_at DESC").Find(&users).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not list users", "error", err)
+		p.Error = errors.New("could not list users")
+		return
+	}
+	var suppressions []models.Suppression
+	if err := db.WithContext(r.Context()).Find(&suppressions).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not list suppressions", "error", err)
+		p.Error = errors.New("could not list suppressions")
+		return
+	}
+	byEmail := make(map[string]*models.Suppression, len(suppressions))
+	for i := range suppressions {
+		byEmail[suppressions[i].Email] = &suppressions[i]
+	}
+	for _, u := range users {
+		p.Users = append(p.Users, AdminUserRow{User: u, Suppression: byEmail[email.NormaliseAddress(u.Email)]})
+	}
+}
@@ -1,22 +1,28 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/schema"
 	"github.com/gorilla/sessions"
 	"github.com/nuric/go-web-app-template/auth"
 	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/geoip"
 	"github.com/nuric/go-web-app-template/middleware"
+	"github.com/nuric/go-web-app-template/scan"
 	"github.com/nuric/go-web-app-template/static"
 	"github.com/nuric/go-web-app-template/storage"
 	"github.com/nuric/go-web-app-template/templates"
+	"github.com/nuric/go-web-app-template/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -31,6 +37,15 @@ var ss sessions.Store
 var em email.Emailer
 var st storage.Storer
 
+// Used to build absolute links in emails
+var baseURL string
+
+// Optional, used to show where logins come from
+var geo *geoip.DB
+
+// Signs and verifies links to stored files for logged out viewers
+var urlSigner storage.URLSigner
+
 type Config struct {
 	Mux        *http.ServeMux
 	Database   *gorm.DB
@@ -39,6 +54,29 @@ type Config struct {
 	Storer     storage.Storer
 	CSRFSecret string
 	Debug      bool
+	// Public URL of the application without a trailing slash, e.g.
+	// https://example.com
+	BaseURL string
+	// Optional offline GeoIP database for login alerts
+	GeoIP *geoip.DB
+	// Secret for signed upload URLs, see storage.URLSigner
+	URLSecret string
+	// Bounce and complaint webhook parsers keyed by provider name, e.g.
+	// "mailgun" is served at /webhooks/email/mailgun
+	EmailWebhooks map[string]email.WebhookParser
+	// Most bytes a user can have in incomplete resumable uploads
+	UploadLimit int64
+	// Bytes users of each role may store, roles without a quota are
+	// unlimited. Individual users can be given their own quota.
+	StorageQuotas map[string]int64
+	// Scans uploads before they are stored, nothing is scanned when nil
+	Scanner scan.Scanner
+	// Store uploads larger than the Scanner accepts without scanning them,
+	// recording each in the audit log, instead of rejecting them
+	AllowUnscanned bool
+	// Applies the rate limit policies of each route, nothing is limited
+	// when nil
+	RateLimiter *middleware.RateLimiter
 }
 
 // SetDB sets the global database connection
@@ -47,6 +85,15 @@ func Setup(c Config) http.Handler {
 	ss = c.Session
 	em = c.Emailer
 	st = c.Storer
+	baseURL = strings.TrimSuffix(c.BaseURL, "/")
+	geo = c.GeoIP
+	storageQuotas = c.StorageQuotas
+	if c.Scanner != nil {
+		scanner = c.Scanner
+	}
+	allowUnscanned = c.AllowUnscanned
+	urlSigner = storage.URLSigner{Secret: []byte(c.URLSecret), Prefix: "/uploads/"}
+	templates.URLSigner = signedUploadURL
 	slog.Debug("Database and session store set", "database", db.Name(), "session", fmt.Sprintf("%T", ss), "emailer", fmt.Sprintf("%T", em), "storer", st.Name())
 	// ---------------------------
 	// Handle static files
@@ -54,41 +101,91 @@ func Setup(c Config) http.Handler {
 	if mux == nil {
 		mux = http.NewServeMux()
 	}
-	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static.FS)))
+	mux.Handle("GET /static/", http.StripPrefix("/static/", middleware.PrecompressedFileServer(static.FS)))
 	mux.HandleFunc("GET /favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "static/favicon.ico")
 	})
 	// Our routes
-	mux.Handle("/login", PageHandler(func() AppPager {
+	limit := func(p middleware.Policy, h http.Handler) http.Handler {
+		if c.RateLimiter == nil {
+			return h
+		}
+		return c.RateLimiter.Limit(p, h)
+	}
+	mux.Handle("/login", limit(authRateLimit, PageHandler(func() AppPager {
 		return &LoginPage{BasePage: BasePage{Title: "Login", Template: "login.html"}}
-	}))
-	mux.Handle("GET /logout", LogoutPage{})
-	mux.Handle("/signup", PageHandler(func() AppPager {
+	})))
+	mux.Handle("GET /logout", limit(pageRateLimit, LogoutPage{}))
+	mux.Handle("/signup", limit(authRateLimit, PageHandler(func() AppPager {
 		return &SignUpPage{BasePage: BasePage{Title: "Sign Up", Template: "signup.html"}}
-	}))
-	mux.Handle("/verify-email", PageHandler(func() AppPager {
+	})))
+	mux.Handle("/verify-email", limit(authRateLimit, PageHandler(func() AppPager {
 		return &VerifyEmailPage{BasePage: BasePage{Title: "Verify Email", Template: "verify_email.html"}}
-	}))
-	mux.Handle("/reset-password", PageHandler(func() AppPager {
+	})))
+	mux.Handle("/reset-password", limit(authRateLimit, PageHandler(func() AppPager {
 		return &ResetPasswordPage{BasePage: BasePage{Title: "Reset Password", Template: "reset_password.html"}}
-	}))
-	mux.Handle("GET /dashboard", auth.VerifiedOnly(PageHandler(func() AppPager {
-		return &DashboardPage{BasePage: BasePage{Title: "Dashboard", Template: "dashboard.html"}}
 	})))
-	mux.Handle("/account", auth.VerifiedOnly(PageHandler(func() AppPager {
-		return &AccountPage{BasePage: BasePage{Title: "Account", Template: "account.html"}}
+	mux.Handle("/undo-email-change", limit(authRateLimit, PageHandler(func() AppPager {
+		return &UndoEmailChangePage{BasePage: BasePage{Title: "Undo Email Change", Template: "undo_email_change.html"}}
 	})))
-	mux.Handle("GET /uploads/", auth.VerifiedOnly(http.StripPrefix("/uploads/", http.FileServerFS(st))))
+	mux.Handle("GET /dashboard", limit(pageRateLimit, auth.VerifiedOnly(PageHandler(func() AppPager {
+		return &DashboardPage{BasePage: BasePage{Title: "Dashboard", Template: "dashboard.html"}}
+	}))))
+	mux.Handle("/account", limit(pageRateLimit, auth.VerifiedOnly(PageHandler(func() AppPager {
+		return &AccountPage{BasePage: BasePage{Title: "Account", Template: "account.html"}}
+	}))))
+	mux.Handle("/admin/users", limit(pageRateLimit, auth.VerifiedOnly(auth.AdminOnly(PageHandler(func() AppPager {
+		return &AdminUsersPage{BasePage: BasePage{Title: "Users", Template: "admin_users.html"}}
+	})))))
+	mux.Handle("POST /webhooks/email/{provider}", limit(webhookRateLimit, EmailWebhook{Parsers: c.EmailWebhooks}))
+	// Access to each file is checked against its upload metadata
+	mux.Handle("GET /uploads/{path...}", limit(fileRateLimit, UploadsHandler{}))
+	// Resumable uploads using the tus protocol
+	tus := limit(uploadRateLimit, auth.VerifiedOnly(TusHandler{Limit: c.UploadLimit, Expiry: 24 * time.Hour}))
+	mux.Handle("/tus/{$}", tus)
+	mux.Handle("/tus/{id}", tus)
 	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard", http.StatusSeeOther))
 	// Middleware
-	var handler http.Handler = mux
+	var handler http.Handler = requestDetails(middleware.Metrics(mux))
 	// https://github.com/gorilla/csrf/issues/190
-	handler = auth.UserMiddleware(handler, db, ss)
-	handler = csrf.Protect([]byte(c.CSRFSecret), csrf.Secure(!c.Debug), csrf.TrustedOrigins([]string{"localhost:8080"}))(handler)
-	handler = middleware.NotFoundRenderer(handler)
+	handler = middleware.TraceLayer("middleware.user", auth.UserMiddleware(handler, db, ss))
+	handler = middleware.TraceLayer("middleware.csrf", csrf.Protect([]byte(c.CSRFSecret), csrf.Secure(!c.Debug), csrf.TrustedOrigins([]string{"localhost:8080"}))(handler))
+	// Webhooks are authenticated by their own signatures instead
+	handler = csrfExempt(handler, "/webhooks/")
+	handler = middleware.ErrorPageRenderer(handler)
 	return handler
 }
 
+// storer returns the Storer bound to ctx so its operations show up in the
+// trace of the request.
+func storer(ctx context.Context) storage.Storer {
+	return storage.WithContext(ctx, st)
+}
+
+// requestDetails names the user and matched route in the access log and
+// trace, only the mux knows the route and it sets it on the request it was
+// given.
+func requestDetails(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			middleware.SetRoute(r)
+			if user := auth.GetCurrentUser(r); user.ID != 0 {
+				middleware.AnnotateAccessLog(r.Context(), slog.Uint64("userId", uint64(user.ID)))
+			}
+		}()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func csrfExempt(next http.Handler, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 type Validator interface {
 	Validate() bool
 }
@@ -136,6 +233,8 @@ type BasePage struct {
 	// Used to protect form submissions. Note that all forms on the same page
 	// share the same CSRF token.
 	CSRF template.HTML
+	// Every <script> and <style> needs it to pass the Content-Security-Policy
+	CSPNonce string
 	// Flash messages to be displayed on the page
 	FlashMessages []FlashMessage
 	// Used for redirects after form submissions
@@ -165,9 +264,10 @@ const (
 
 func (p *BasePage) PreHandle(r *http.Request) {
 	p.CSRF = csrf.TemplateField(r)
+	p.CSPNonce = middleware.CSPNonce(r)
 	session, err := ss.Get(r, "flash")
 	if err != nil {
-		slog.Error("could not get flash session", "error", err)
+		slog.ErrorContext(r.Context(), "could not get flash session", "error", err)
 		return
 	}
 	if flashes := session.Flashes(); len(flashes) > 0 {
@@ -187,7 +287,7 @@ func (p *BasePage) PreHandle(r *http.Request) {
 func (p *BasePage) Flash(r *http.Request, level string, message string) {
 	session, err := ss.Get(r, "flash")
 	if err != nil {
-		slog.Error("could not get flash session", "error", err)
+		slog.ErrorContext(r.Context(), "could not get flash session", "error", err)
 	}
 	session.AddFlash(fmt.Sprintf("%s$$%s", level, message))
 }
@@ -199,11 +299,11 @@ func (p *BasePage) Handle(w http.ResponseWriter, r *http.Request) {
 func (p *BasePage) PostHandle(w http.ResponseWriter, r *http.Request) {
 	session, err := ss.Get(r, "flash")
 	if err != nil {
-		slog.Error("could not get flash session", "error", err)
+		slog.ErrorContext(r.Context(), "could not get flash session", "error", err)
 		return
 	}
 	if err := session.Save(r, w); err != nil {
-		slog.Error("could not save flash session", "error", err)
+		slog.ErrorContext(r.Context(), "could not save flash session", "error", err)
 	}
 }
 
@@ -214,9 +314,9 @@ func PageHandler(factory func() AppPager) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		page.PreHandle(r)
-		page.Handle(w, r)
-		page.PostHandle(w, r)
+		pageSpan(r, "page.PreHandle", func() { page.PreHandle(r) })
+		pageSpan(r, "page.Handle", func() { page.Handle(w, r) })
+		pageSpan(r, "page.PostHandle", func() { page.PostHandle(w, r) })
 		switch {
 		case page.NotFound():
 			http.NotFound(w, r)
@@ -225,23 +325,40 @@ func PageHandler(factory func() AppPager) http.Handler {
 			http.Redirect(w, r, page.Redirect(), http.StatusSeeOther)
 			return
 		default:
-			templates.RenderHTML(w, page.TemplateName(), page)
+			pageSpan(r, "page.render", func() { templates.RenderHTML(w, page.TemplateName(), page) })
 		}
 	})
 }
 
+// pageSpan runs a phase of a page in its own span. The request is updated in
+// place rather than copied because gorilla/sessions keeps its registry on it
+// and a copy would lose the flashes read in PreHandle.
+func pageSpan(r *http.Request, name string, phase func()) {
+	parent := trace.SpanFromContext(r.Context())
+	ctx, span := tracing.Tracer().Start(r.Context(), name)
+	*r = *r.WithContext(ctx)
+	defer func() {
+		span.End()
+		// Keep whatever the phase added to the context but leave its span
+		*r = *r.WithContext(trace.ContextWithSpan(r.Context(), parent))
+	}()
+	phase()
+}
+
 // Helper function to send a template email
-func sendTemplateEmail(to, subject, templateName string, data any) error {
+func sendTemplateEmail(ctx context.Context, to, subject, templateName string, data any) error {
 	// Render the template to a string
 	body, err := templates.RenderEmail(templateName, data)
 	if err != nil {
-		slog.Error("could not render email template", "error", err)
+		slog.ErrorContext(ctx, "could not render email template", "error", err)
 		return errors.New("could not render email template")
 	}
 	// Send the email using the emailer
-	if err := em.SendEmail(to, subject, body); err != nil {
-		slog.Error("could not send email", "error", err)
+	if err := em.SendEmail(ctx, to, subject, body); err != nil {
+		emailsSent.Inc(templateName, "failure")
+		slog.ErrorContext(ctx, "could not send email", "error", err)
 		return errors.New("could not send email")
 	}
+	emailsSent.Inc(templateName, "success")
 	return nil
 }
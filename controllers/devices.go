@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/nuric/go-web-app-template/middleware"
+	"github.com/nuric/go-web-app-template/models"
+)
+
+// We store at most this much of the user agent string
+const maxUserAgentLength = 255
+
+type device struct {
+	UserAgent string
+	IP        string
+	IPPrefix  string
+	Location  string
+}
+
+// currentDevice identifies the device of the request. Addresses are grouped
+// into the network a device is likely to stay in, /24 for IPv4 and /48 for
+// IPv6, so that dynamic addresses don't trigger alerts on every login.
+func currentDevice(r *http.Request) device {
+	d := device{UserAgent: r.UserAgent(), IP: middleware.ClientIP(r)}
+	if len(d.UserAgent) > maxUserAgentLength {
+		d.UserAgent = d.UserAgent[:maxUserAgentLength]
+	}
+	addr, err := netip.ParseAddr(d.IP)
+	if err != nil {
+		d.IPPrefix = d.IP
+		return d
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	d.IPPrefix = prefix.String()
+	d.Location = geo.Lookup(addr)
+	return d
+}
+
+func (d device) matches(k models.KnownDevice) bool {
+	return d.UserAgent == k.UserAgent && d.IPPrefix == k.IPPrefix
+}
+
+// recordLoginDevice remembers the device of a successful login and sends a
+// security email if the user has not logged in from it before. Errors are
+// logged but never block the login.
+func recordLoginDevice(r *http.Request, user models.User) {
+	d := currentDevice(r)
+	var known []models.KnownDevice
+	if err := db.WithContext(r.Context()).Where("user_id = ?", user.ID).Find(&known).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not load known devices", "error", err, "userId", user.ID)
+		return
+	}
+	now := time.Now()
+	if i := slices.IndexFunc(known, d.matches); i >= 0 {
+		if err := db.WithContext(r.Context()).Model(&known[i]).Updates(models.KnownDevice{LastIP: d.IP, LastSeenAt: now}).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not update known device", "error", err, "userId", user.ID)
+		}
+		return
+	}
+	newDevice := models.KnownDevice{
+		UserID:     user.ID,
+		UserAgent:  d.UserAgent,
+		IPPrefix:   d.IPPrefix,
+		Location:   d.Location,
+		LastIP:     d.IP,
+		LastSeenAt: now,
+	}
+	if err := db.WithContext(r.Context()).Create(&newDevice).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not create known device", "error", err, "userId", user.ID)
+		return
+	}
+	// The very first device, usually at sign up, has nothing to compare with
+	if len(known) == 0 {
+		return
+	}
+	newLocation := d.Location != "" && !slices.ContainsFunc(known, func(k models.KnownDevice) bool {
+		return k.Location == d.Location
+	})
+	emailData := map[string]any{
+		"Time":        now.UTC().Format("2006-01-02 15:04 MST"),
+		"IP":          d.IP,
+		"Location":    d.Location,
+		"NewLocation": newLocation,
+		"UserAgent":   d.UserAgent,
+		"AccountURL":  baseURL + "/account",
+	}
+	if err := sendTemplateEmail(r.Context(), user.Email, "New login to your account", "new_device_login.txt", emailData); err != nil {
+		slog.ErrorContext(r.Context(), "could not send new device email", "error", err, "userId", user.ID)
+	}
+	slog.InfoContext(r.Context(), "Login from new device", "userId", user.ID, "ipPrefix", d.IPPrefix, "location", d.Location)
+}
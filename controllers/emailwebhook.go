@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/utils"
+	"gorm.io/gorm/clause"
+)
+
+// EmailWebhook receives bounce and complaint notifications from email
+// providers and adds the affected addresses to the suppression list.
+type EmailWebhook struct {
+	Parsers map[string]email.WebhookParser
+}
+
+func (h EmailWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	provider := r.PathValue("provider")
+	parser, ok := h.Parsers[provider]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		utils.Encode(w, http.StatusBadRequest, map[string]string{"error": "could not read body"})
+		return
+	}
+	events, err := parser.Parse(r, body)
+	if errors.Is(err, email.ErrInvalidSignature) {
+		slog.WarnContext(r.Context(), "email webhook signature rejected", "provider", provider, "error", err)
+		utils.Encode(w, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "could not parse email webhook", "provider", provider, "error", err)
+		utils.Encode(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+		return
+	}
+	for _, e := range events {
+		s := models.Suppression{
+			Email:    email.NormaliseAddress(e.Email),
+			Reason:   e.Type,
+			Provider: provider,
+			Detail:   e.Detail,
+		}
+		// Repeated notifications for the same address just refresh the reason
+		if err := db.WithContext(r.Context()).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}},
+			DoUpdates: clause.AssignmentColumns([]string{"reason", "provider", "detail", "updated_at"}),
+		}).Create(&s).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not store suppression", "error", err)
+			utils.Encode(w, http.StatusInternalServerError, map[string]string{"error": "could not store event"})
+			return
+		}
+		slog.InfoContext(r.Context(), "Email address suppressed", "email", s.Email, "reason", s.Reason, "provider", provider)
+	}
+	utils.Encode(w, http.StatusOK, map[string]any{"status": "ok", "suppressed": len(events)})
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -41,22 +42,28 @@ func (p *LoginPage) Handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var user models.User
-		if err := db.Where("email = ?", f.Email).First(&user).Error; err != nil {
-			slog.Debug("could not find user", "error", err, "email", f.Email)
+		if err := db.WithContext(r.Context()).Where("email = ?", f.Email).First(&user).Error; err != nil {
+			slog.DebugContext(r.Context(), "could not find user", "error", err, "email", f.Email)
 			f.Error = errors.New("invalid email or password")
 			return
 		}
 		if !utils.VerifyPassword(user.Password, f.Password) {
-			slog.Debug("password verification failed", "userId", user.ID)
+			slog.DebugContext(r.Context(), "password verification failed", "userId", user.ID)
 			f.Error = errors.New("invalid email or password")
 			return
 		}
+		if user.Locked {
+			slog.DebugContext(r.Context(), "login attempt on locked account", "userId", user.ID)
+			f.Error = errors.New("this account is locked, please reset your password to unlock it")
+			return
+		}
 		if err := auth.LogUserIn(w, r, user.ID, ss); err != nil {
-			slog.Error("could not log user in", "error", err, "userId", user.ID)
+			slog.ErrorContext(r.Context(), "could not log user in", "error", err, "userId", user.ID)
 			f.Error = errors.New("could not log user in")
 			return
 		}
-		slog.Debug("User logged in successfully", "userId", user.ID, "email", f.Email)
+		recordLoginDevice(r, user)
+		slog.DebugContext(r.Context(), "User logged in successfully", "userId", user.ID, "email", f.Email)
 		// Redirect to dashboard
 		p.redirect = "/dashboard"
 	case "forgot_password":
@@ -66,26 +73,11 @@ func (p *LoginPage) Handle(w http.ResponseWriter, r *http.Request) {
 			f.Error = err
 			return
 		}
-		resetToken := models.Token{
-			Email:     f.Email,
-			Token:     utils.HumanFriendlyToken(),
-			Purpose:   "reset_password",
-			ExpiresAt: time.Now().Add(15 * time.Minute),
-		}
-		if err := db.Create(&resetToken).Error; err != nil {
-			slog.Error("could not create password reset token", "error", err)
-			f.Error = errors.New("could not send password reset email")
-			return
-		}
-		emailData := map[string]any{
-			"Token": resetToken.Token,
-		}
-		if err := sendTemplateEmail(f.Email, "Password Reset", "reset_password.txt", emailData); err != nil {
-			slog.Error("could not send password reset email", "error", err)
+		if err := sendPasswordReset(r.Context(), f.Email); err != nil {
 			f.Error = err
 			return
 		}
-		slog.Debug("Forgot password request", "email", f.Email)
+		slog.DebugContext(r.Context(), "Forgot password request", "email", f.Email)
 		p.Flash(r, FlashInfo, "Password reset email sent. Please check your inbox.")
 		p.redirect = fmt.Sprintf("/reset-password?email=%s", f.Email)
 	default:
@@ -93,6 +85,27 @@ func (p *LoginPage) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func sendPasswordReset(ctx context.Context, email string) error {
+	resetToken := models.Token{
+		Email:     email,
+		Token:     utils.HumanFriendlyToken(),
+		Purpose:   "reset_password",
+		ExpiresAt: time.Now().Add(15 * time.Minute),
+	}
+	if err := db.WithContext(ctx).Create(&resetToken).Error; err != nil {
+		slog.ErrorContext(ctx, "could not create password reset token", "error", err)
+		return errors.New("could not send password reset email")
+	}
+	emailData := map[string]any{
+		"Token": resetToken.Token,
+	}
+	if err := sendTemplateEmail(ctx, email, "Password Reset", "reset_password.txt", emailData); err != nil {
+		slog.ErrorContext(ctx, "could not send password reset email", "error", err)
+		return err
+	}
+	return nil
+}
+
 type LoginForm struct {
 	Email         string `schema:"email"`
 	EmailError    error
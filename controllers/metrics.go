@@ -0,0 +1,16 @@
+package controllers
+
+import (
+	"github.com/nuric/go-web-app-template/metrics"
+)
+
+/* Application metrics, request counts and latencies are recorded by the
+ * middleware. Label values are template names and fixed strings, never user
+ * input, so the number of series stays small. */
+
+var (
+	emailsSent = metrics.Default.Counter("emails_sent_total",
+		"Emails handed to the emailer by template and result.", "template", "result")
+	uploadBytes = metrics.Default.Counter("upload_bytes_total",
+		"Bytes received in uploads by kind.", "kind")
+)
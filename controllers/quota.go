@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/utils"
+	"gorm.io/gorm"
+)
+
+/* Everything a user uploads is recorded as an Upload with its size, so usage
+ * is the sum of those plus the full size of resumable uploads still in
+ * progress, which we reserve up front. Replaced files keep counting until the
+ * garbage collector removes them since they still take up space.
+ *
+ * Checking and storing must happen in one transaction, otherwise parallel
+ * uploads could each pass the check and together go over the quota. The
+ * check first locks the row of the user with a no-op update so concurrent
+ * checks of the same user wait for the transaction holding it to finish. */
+
+// Quotas by role, roles without one are unlimited
+var storageQuotas map[string]int64
+
+var ErrQuotaExceeded = errors.New("not enough storage left")
+
+// storageQuota returns the bytes the user may store, 0 meaning no limit.
+func storageQuota(user models.User) int64 {
+	if user.StorageQuota > 0 {
+		return user.StorageQuota
+	}
+	return storageQuotas[user.Role]
+}
+
+func storageUsage(tx *gorm.DB, userID uint) (int64, error) {
+	var stored, reserved int64
+	if err := tx.Model(&models.Upload{}).Where("owner_id = ?", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&stored).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&models.ResumableUpload{}).Where("owner_id = ? AND upload_id = 0 AND expires_at > ?", userID, time.Now()).
+		Select("COALESCE(SUM(size), 0)").Scan(&reserved).Error; err != nil {
+		return 0, err
+	}
+	return stored + reserved, nil
+}
+
+// lockUserStorage makes other transactions checking the storage of the user
+// wait until tx is done.
+func lockUserStorage(tx *gorm.DB, userID uint) error {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).UpdateColumn("id", gorm.Expr("id")).Error; err != nil {
+		return fmt.Errorf("could not lock user: %w", err)
+	}
+	return nil
+}
+
+// checkQuota returns a user friendly error wrapping ErrQuotaExceeded if
+// storing size more bytes would take the user over their quota. It must run
+// in the transaction that records the bytes.
+func checkQuota(tx *gorm.DB, user models.User, size int64) error {
+	quota := storageQuota(user)
+	if quota <= 0 {
+		return nil
+	}
+	if err := lockUserStorage(tx, user.ID); err != nil {
+		return err
+	}
+	used, err := storageUsage(tx, user.ID)
+	if err != nil {
+		return fmt.Errorf("could not check storage usage: %w", err)
+	}
+	if used+size > quota {
+		return fmt.Errorf("%w: this needs %s but only %s of your %s is left", ErrQuotaExceeded,
+			utils.FormatBytes(size), utils.FormatBytes(max(quota-used, 0)), utils.FormatBytes(quota))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// setupQuotaDB points the controllers at a fresh database. A file rather than
+// :memory: so concurrent transactions share it.
+func setupQuotaDB(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "quota.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	var err error
+	db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Upload{}, &models.ResumableUpload{}))
+	storageQuotas = map[string]int64{"basic": 1000}
+	t.Cleanup(func() { storageQuotas = nil })
+}
+
+func TestStorageUsage(t *testing.T) {
+	setupQuotaDB(t)
+	alice := models.User{Email: "alice@example.com", Password: "x"}
+	bob := models.User{Email: "bob@example.com", Password: "x"}
+	require.NoError(t, db.Create(&alice).Error)
+	require.NoError(t, db.Create(&bob).Error)
+	require.NoError(t, db.Create(&[]models.Upload{
+		{Path: "a/1", OwnerID: alice.ID, ContentType: "text/plain", Size: 100},
+		{Path: "a/2", OwnerID: alice.ID, ContentType: "text/plain", Size: 50},
+		{Path: "b/1", OwnerID: bob.ID, ContentType: "text/plain", Size: 500},
+	}).Error)
+	require.NoError(t, db.Create(&[]models.ResumableUpload{
+		// Reserved while in progress
+		{UUID: "active", OwnerID: alice.ID, Size: 200, ExpiresAt: time.Now().Add(time.Hour)},
+		// Expired and complete ones no longer count, the latter is an Upload
+		{UUID: "expired", OwnerID: alice.ID, Size: 400, ExpiresAt: time.Now().Add(-time.Hour)},
+		{UUID: "complete", OwnerID: alice.ID, Size: 100, ExpiresAt: time.Now().Add(time.Hour), UploadID: 1},
+	}).Error)
+
+	used, err := storageUsage(db, alice.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(350), used)
+	used, err = storageUsage(db, bob.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), used)
+	used, err = storageUsage(db, 999)
+	require.NoError(t, err)
+	require.Zero(t, used)
+}
+
+func TestCheckQuota(t *testing.T) {
+	setupQuotaDB(t)
+	tests := []struct {
+		name    string
+		user    models.User
+		used    int64
+		size    int64
+		wantErr bool
+	}{
+		{"UnderQuota", models.User{Role: "basic"}, 400, 500, false},
+		{"ExactlyQuota", models.User{Role: "basic"}, 400, 600, false},
+		{"OverQuota", models.User{Role: "basic"}, 400, 601, true},
+		{"UnlimitedRole", models.User{Role: "admin"}, 400, 1 << 40, false},
+		{"UserQuota", models.User{Role: "basic", StorageQuota: 5000}, 400, 4000, false},
+		{"OverUserQuota", models.User{Role: "admin", StorageQuota: 500}, 400, 101, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			user.Email = tt.name + "@example.com"
+			user.Password = "x"
+			require.NoError(t, db.Create(&user).Error)
+			require.NoError(t, db.Create(&models.Upload{Path: tt.name, OwnerID: user.ID, ContentType: "text/plain", Size: tt.used}).Error)
+			err := checkQuota(db, user, tt.size)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrQuotaExceeded)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Parallel uploads must not be able to pass the check together and go over
+// the quota.
+func TestCheckQuota_Concurrent(t *testing.T) {
+	setupQuotaDB(t)
+	user := models.User{Email: "alice@example.com", Password: "x", Role: "basic"}
+	require.NoError(t, db.Create(&user).Error)
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			_ = db.Transaction(func(tx *gorm.DB) error {
+				if err := checkQuota(tx, user, 300); err != nil {
+					return err
+				}
+				return tx.Create(&models.Upload{Path: "file/" + string(rune('a'+i)), OwnerID: user.ID, ContentType: "text/plain", Size: 300}).Error
+			})
+		})
+	}
+	wg.Wait()
+	used, err := storageUsage(db, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(900), used)
+}
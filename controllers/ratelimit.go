@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/middleware"
+)
+
+/* Rate limit policies of our routes. Forms that don't need a login are what
+ * attackers go for, guessing passwords or flooding inboxes, so they get the
+ * tightest limit. Logged in users are limited by account rather than IP so
+ * people behind the same NAT don't share a limit, and requests made with an
+ * API token by the token so each integration of a user has its own. Only
+ * tokens auth.UserMiddleware verified count, anything else in the header is
+ * ignored so made up tokens can't reset a limit. Static files are not
+ * limited at all. */
+
+var (
+	authRateLimit    = middleware.Policy{Name: "auth", Requests: 20, Window: time.Minute}
+	pageRateLimit    = middleware.Policy{Name: "page", Requests: 120, Window: time.Minute, Key: keyByAPIToken}
+	fileRateLimit    = middleware.Policy{Name: "file", Requests: 600, Window: time.Minute, Key: keyByAPIToken}
+	uploadRateLimit  = middleware.Policy{Name: "upload", Requests: 600, Window: time.Minute, Key: keyByUser}
+	webhookRateLimit = middleware.Policy{Name: "webhook", Requests: 600, Window: time.Minute}
+)
+
+// keyByUser counts requests against the logged in user, falling back to the
+// client IP for everyone else.
+func keyByUser(r *http.Request) string {
+	if user := auth.GetCurrentUser(r); user.ID != 0 {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return ""
+}
+
+// keyByAPIToken counts requests against the API token they were authenticated
+// with, and everything else like keyByUser.
+func keyByAPIToken(r *http.Request) string {
+	if id := auth.GetAPIToken(r); id != 0 {
+		return fmt.Sprintf("token:%d", id)
+	}
+	return keyByUser(r)
+}
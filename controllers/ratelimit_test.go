@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/sessions"
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/middleware"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestKeyByAPIToken(t *testing.T) {
+	tokenDB, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "tokens.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, tokenDB.AutoMigrate(&models.User{}, &models.Token{}))
+	alice := models.User{Email: "alice@example.com", Password: "x"}
+	mallory := models.User{Email: "mallory@example.com", Password: "x", Locked: true}
+	require.NoError(t, tokenDB.Create(&alice).Error)
+	require.NoError(t, tokenDB.Create(&mallory).Error)
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, tokenDB.Create(&[]models.Token{
+		{UserID: alice.ID, Token: "first", Purpose: auth.APITokenPurpose, ExpiresAt: expires},
+		{UserID: alice.ID, Token: "second", Purpose: auth.APITokenPurpose, ExpiresAt: expires},
+		{UserID: alice.ID, Token: "expired", Purpose: auth.APITokenPurpose, ExpiresAt: time.Now().Add(-time.Hour)},
+		{UserID: alice.ID, Token: "reset", Purpose: "reset_password", ExpiresAt: expires},
+		{UserID: mallory.ID, Token: "locked", Purpose: auth.APITokenPurpose, ExpiresAt: expires},
+	}).Error)
+
+	rl := middleware.NewRateLimiter(nil, time.Hour)
+	t.Cleanup(rl.Stop)
+	p := middleware.Policy{Name: "api", Requests: 1, Window: time.Minute, Key: keyByAPIToken}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := auth.UserMiddleware(rl.Limit(p, ok), tokenDB, sessions.NewCookieStore([]byte("32-character-long-secret-key-abc")))
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"Token", "first", http.StatusOK},
+		{"TokenAgain", "first", http.StatusTooManyRequests},
+		// Each token has its own limit
+		{"OtherToken", "second", http.StatusOK},
+		// Anything that isn't a valid API token counts against the IP
+		{"Guest", "", http.StatusOK},
+		{"Rotated", "made-up-1", http.StatusTooManyRequests},
+		{"RotatedAgain", "made-up-2", http.StatusTooManyRequests},
+		{"Expired", "expired", http.StatusTooManyRequests},
+		{"OtherPurpose", "reset", http.StatusTooManyRequests},
+		{"LockedUser", "locked", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			require.Equal(t, tt.want, w.Code)
+		})
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/nuric/go-web-app-template/auth"
 	"github.com/nuric/go-web-app-template/models"
 	"github.com/nuric/go-web-app-template/utils"
-	"gorm.io/gorm"
 )
 
 type ResetPasswordPage struct {
@@ -61,31 +60,35 @@ func (p *ResetPasswordPage) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var token models.Token
-	if err := db.Where("token = ?", p.Token).
+	if err := db.WithContext(r.Context()).Where("token = ?", p.Token).
 		Where("email = ?", p.Email).
 		Where("purpose = ?", "reset_password").
 		Where("expires_at > ?", time.Now()).
 		Order("created_at DESC").
 		First(&token).Error; err != nil {
-		slog.Error("could not find valid token", "error", err)
+		slog.ErrorContext(r.Context(), "could not find valid token", "error", err)
 		p.Error = errors.New("invalid token")
 		return
 	}
 	if p.Token != token.Token {
-		slog.Error("password reset token mismatch")
+		slog.ErrorContext(r.Context(), "password reset token mismatch")
 		p.Error = errors.New("invalid token")
 		return
 	}
-	// Reset the user's password
-	rows, err := gorm.G[models.User](db).Where("email = ?", p.Email).Update(r.Context(), "password", utils.HashPassword(p.NewPassword))
-	if err != nil || rows == 0 {
-		slog.Error("could not update user password", "error", err)
+	// Reset the user's password, proving ownership of the email also unlocks
+	// the account
+	res := db.WithContext(r.Context()).Model(&models.User{}).Where("email = ?", p.Email).Updates(map[string]any{
+		"password": utils.HashPassword(p.NewPassword),
+		"locked":   false,
+	})
+	if res.Error != nil || res.RowsAffected == 0 {
+		slog.ErrorContext(r.Context(), "could not update user password", "error", res.Error)
 		p.Error = errors.New("could not update password")
 		return
 	}
 	// Delete the token after successful password reset
-	if err := db.Delete(&token).Error; err != nil {
-		slog.Error("could not delete reset token", "error", err)
+	if err := db.WithContext(r.Context()).Delete(&token).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not delete reset token", "error", err)
 	}
 
 	// Jobs done, they can now login with the new password
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/scan"
+)
+
+/* Every upload is scanned before it is committed to the Storer. Flagged
+ * content is never stored where it could be served, instead it is copied to
+ * quarantine/<uuid> for an administrator to review, which the garbage
+ * collector leaves alone, and an audit event records who uploaded what. When
+ * the scanner fails we reject the upload rather than let it through.
+ *
+ * Content larger than the scanner accepts is rejected too, otherwise padding
+ * a file would be enough to get it past the scanner. Deployments that accept
+ * the risk can opt in to storing it unscanned, with an audit event recording
+ * each one so administrators can see what was not checked. */
+
+var (
+	scanner        scan.Scanner = scan.NopScanner{}
+	allowUnscanned bool
+)
+
+var (
+	ErrInfected       = errors.New("file was flagged by the malware scanner")
+	ErrTooLargeToScan = errors.New("file is too large to be scanned for malware")
+)
+
+// scanUpload scans the content returned by open. open is called a second time
+// to quarantine flagged content so it must return the same data each time.
+func scanUpload(ctx context.Context, userID uint, source string, open func() (io.ReadCloser, error)) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	res, err := scanner.Scan(ctx, rc)
+	rc.Close()
+	if errors.Is(err, scan.ErrTooLarge) {
+		slog.WarnContext(ctx, "upload too large to scan", "userId", userID, "source", source, "stored", allowUnscanned)
+		if !allowUnscanned {
+			return ErrTooLargeToScan
+		}
+		recordAuditEvent(ctx, models.AuditEvent{
+			UserID: userID,
+			Action: models.AuditUploadNotScanned,
+			Detail: fmt.Sprintf("%s stored unscanned, it is larger than the scanner accepts", source),
+		})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("scan upload: %w", err)
+	}
+	if !res.Infected {
+		return nil
+	}
+	name := "quarantine/" + uuid.New().String()
+	slog.WarnContext(ctx, "upload flagged by malware scanner", "userId", userID, "source", source, "signature", res.Signature, "quarantine", name)
+	if err := quarantine(ctx, name, open); err != nil {
+		slog.ErrorContext(ctx, "could not quarantine upload", "error", err)
+		name = "not kept"
+	}
+	recordAuditEvent(ctx, models.AuditEvent{
+		UserID: userID,
+		Action: models.AuditUploadQuarantined,
+		Detail: fmt.Sprintf("%s flagged as %s, quarantined at %s", source, res.Signature, name),
+	})
+	return ErrInfected
+}
+
+func recordAuditEvent(ctx context.Context, event models.AuditEvent) {
+	if err := db.WithContext(ctx).Create(&event).Error; err != nil {
+		slog.ErrorContext(ctx, "could not record audit event", "error", err)
+	}
+}
+
+func quarantine(ctx context.Context, name string, open func() (io.ReadCloser, error)) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	wc, err := storer(ctx).Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(wc, rc); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
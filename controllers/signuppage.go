@@ -57,22 +57,23 @@ func (p *SignUpPage) Handle(w http.ResponseWriter, r *http.Request) {
 		Role:     "basic", // Default role
 	}
 
-	if err := db.Create(&newUser).Error; err != nil {
-		slog.Error("could not create user", "error", err)
+	if err := db.WithContext(r.Context()).Create(&newUser).Error; err != nil {
+		slog.ErrorContext(r.Context(), "could not create user", "error", err)
 		p.Error = errors.New("could not create user")
 		return
 	}
 
 	if err := auth.LogUserIn(w, r, newUser.ID, ss); err != nil {
-		slog.Error("could not log user in after signup", "error", err)
+		slog.ErrorContext(r.Context(), "could not log user in after signup", "error", err)
 		http.Error(w, "could not log user in after signup", http.StatusInternalServerError)
 		return
 	}
 
-	if err := sendEmailVerification(newUser.ID, newUser.Email); err != nil {
-		slog.Error("could not send new user email verification", "error", err)
+	recordLoginDevice(r, newUser)
+	if err := sendEmailVerification(r.Context(), newUser.ID, newUser.Email); err != nil {
+		slog.ErrorContext(r.Context(), "could not send new user email verification", "error", err)
 	}
-	slog.Debug("User signed up successfully", "email", p.Email)
+	slog.DebugContext(r.Context(), "User signed up successfully", "email", p.Email)
 	// Redirect to dashboard
 	p.redirect = "/dashboard"
 }
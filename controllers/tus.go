@@ -0,0 +1,509 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"gorm.io/gorm"
+)
+
+/* Resumable uploads follow the tus protocol with the creation, expiration and
+ * termination extensions so any tus client, e.g. tus-js-client, can be used.
+ * https://tus.io/protocols/resumable-upload
+ *
+ * A Storer can't append to a file, so every PATCH is stored as its own chunk
+ * under tus/<uuid>/. The offset lives in the database and only moves once a
+ * chunk is stored. When a connection drops we keep what arrived and the
+ * client resumes from there. Once the last byte arrives the chunks are
+ * scanned, joined into files/<uuid> and recorded as an Upload.
+ *
+ * Requests for the same upload may reach different replicas, so nothing is
+ * serialised in memory. Each request stores its chunk under a name of its own
+ * and then moves the offset with a conditional update, recording the chunk
+ * in the same transaction. When two requests race for an offset one of them
+ * finds the offset moved, removes its chunk and gets a 409 like any client
+ * with a stale offset. Joining reads the recorded chunks only.
+ *
+ * The joined file is written under tus/<uuid>/ and only renamed to
+ * files/<uuid> once it has every byte, so a request racing another to finish
+ * never replaces the stored file with a partial one, and only one of them
+ * records the Upload. A client retrying the last PATCH after losing our
+ * response gets the final offset back.
+ *
+ * Requests are authenticated with the session cookie, so like forms they need
+ * the CSRF token which tus clients can send in the X-CSRF-Token header. */
+
+const tusVersion = "1.0.0"
+
+type TusHandler struct {
+	// Most bytes a user can have in incomplete uploads at once, which also
+	// caps the size of a single upload
+	Limit int64
+	// Incomplete uploads expire this long after their last chunk
+	Expiry time.Duration
+}
+
+// errOffsetMoved is returned when another request stored a chunk first.
+var errOffsetMoved = errors.New("upload offset moved")
+
+// errUploadFinished is returned when another request recorded the upload.
+var errUploadFinished = errors.New("upload already finished")
+
+// errTooManyPending is returned when incomplete uploads would exceed Limit.
+var errTooManyPending = errors.New("too many incomplete uploads")
+
+func tusChunkPrefix(id string) string {
+	return "tus/" + id + "/"
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, comma separated keys
+// each followed by an optional base64 value.
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for pair := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+func (h TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.Limit, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	user := auth.GetCurrentUser(r)
+	id := r.PathValue("id")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r, user)
+	case id == "":
+		w.Header().Set("Allow", "OPTIONS, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodHead:
+		h.head(w, r, user, id)
+	case r.Method == http.MethodPatch:
+		h.patch(w, r, user, id)
+	case r.Method == http.MethodDelete:
+		h.terminate(w, r, user, id)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h TusHandler) create(w http.ResponseWriter, r *http.Request, user models.User) {
+	// We don't support the creation-defer-length extension
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if size > h.Limit {
+		http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	filename := parseTusMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if len(filename) > 255 {
+		filename = filename[:255]
+	}
+	up := models.ResumableUpload{
+		UUID:      uuid.New().String(),
+		OwnerID:   user.ID,
+		Size:      size,
+		Filename:  filename,
+		ExpiresAt: time.Now().Add(h.Expiry),
+	}
+	// The reservation is checked and made in one go, see checkQuota
+	err = db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := lockUserStorage(tx, user.ID); err != nil {
+			return err
+		}
+		var pending int64
+		err := tx.Model(&models.ResumableUpload{}).
+			Where("owner_id = ? AND upload_id = 0 AND expires_at > ?", user.ID, time.Now()).
+			Select("COALESCE(SUM(size), 0)").Scan(&pending).Error
+		if err != nil {
+			return err
+		}
+		if pending+size > h.Limit {
+			return errTooManyPending
+		}
+		if err := checkQuota(tx, user, size); err != nil {
+			return err
+		}
+		return tx.Create(&up).Error
+	})
+	switch {
+	case errors.Is(err, errTooManyPending):
+		http.Error(w, "Too many incomplete uploads, finish or cancel some first", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "could not create resumable upload", "error", err)
+		http.Error(w, "Could not create upload", http.StatusInternalServerError)
+		return
+	}
+	// Nothing to wait for
+	if size == 0 {
+		if err := finishResumable(r.Context(), &up); err != nil {
+			finishError(w, r, &up, err, "Could not create upload")
+			return
+		}
+	}
+	slog.InfoContext(r.Context(), "Resumable upload created", "uploadId", up.UUID, "userId", user.ID, "size", size)
+	w.Header().Set("Location", "/tus/"+up.UUID)
+	w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// load finds an upload of the user, writing the error response if there is
+// none. Uploads of other users are not found.
+func (h TusHandler) load(w http.ResponseWriter, r *http.Request, user models.User, id string) (models.ResumableUpload, bool) {
+	var up models.ResumableUpload
+	if err := db.WithContext(r.Context()).Where("uuid = ? AND owner_id = ?", id, user.ID).First(&up).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.ErrorContext(r.Context(), "could not load resumable upload", "error", err)
+		}
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return up, false
+	}
+	if up.UploadID == 0 && time.Now().After(up.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return up, false
+	}
+	return up, true
+}
+
+func (h TusHandler) head(w http.ResponseWriter, r *http.Request, user models.User, id string) {
+	up, ok := h.load(w, r, user, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if up.UploadID == 0 {
+		w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h TusHandler) patch(w http.ResponseWriter, r *http.Request, user models.User, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	up, ok := h.load(w, r, user, id)
+	if !ok {
+		return
+	}
+	if offset != up.Received {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+	remaining := up.Size - up.Received
+	if r.ContentLength > remaining {
+		http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if up.UploadID != 0 {
+		// A retry of the last chunk, the client lost our response
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.Received, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// Zero padded so the chunks list in order, the suffix keeps requests
+	// racing for the same offset from writing over each other
+	chunk := fmt.Sprintf("%s%020d-%s", tusChunkPrefix(up.UUID), up.Received, strings.ToLower(rand.Text()))
+	wc, err := storer(r.Context()).Create(chunk)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "could not create upload chunk", "error", err)
+		http.Error(w, "Could not store chunk", http.StatusInternalServerError)
+		return
+	}
+	n, copyErr := io.Copy(wc, io.LimitReader(r.Body, remaining))
+	uploadBytes.Add(float64(n), "resumable")
+	if err := wc.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "could not store upload chunk", "error", err)
+		_ = storer(r.Context()).Remove(chunk)
+		http.Error(w, "Could not store chunk", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		_ = storer(r.Context()).Remove(chunk)
+	} else {
+		received, expires := up.Received+n, time.Now().Add(h.Expiry)
+		err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&models.ResumableUpload{}).Where("id = ? AND received = ?", up.ID, up.Received).
+				Updates(map[string]any{"received": received, "expires_at": expires})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected != 1 {
+				return errOffsetMoved
+			}
+			return tx.Create(&models.ResumableChunk{ResumableUploadID: up.ID, Start: up.Received, Path: chunk, Size: n}).Error
+		})
+		if err != nil {
+			_ = storer(r.Context()).Remove(chunk)
+			if errors.Is(err, errOffsetMoved) {
+				http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+				return
+			}
+			slog.ErrorContext(r.Context(), "could not update upload offset", "error", err, "uploadId", up.UUID)
+			http.Error(w, "Could not store chunk", http.StatusInternalServerError)
+			return
+		}
+		up.Received, up.ExpiresAt = received, expires
+	}
+	if copyErr != nil {
+		// The client went away, it will ask for the offset when it resumes
+		slog.WarnContext(r.Context(), "resumable upload interrupted", "error", copyErr, "uploadId", up.UUID, "offset", up.Received)
+		return
+	}
+	if up.Received == up.Size {
+		if err := finishResumable(r.Context(), &up); err != nil {
+			finishError(w, r, &up, err, "Could not finish upload")
+			return
+		}
+		slog.InfoContext(r.Context(), "Resumable upload completed", "uploadId", up.UUID, "userId", user.ID, "size", up.Size)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Received, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h TusHandler) terminate(w http.ResponseWriter, r *http.Request, user models.User, id string) {
+	up, ok := h.load(w, r, user, id)
+	if !ok {
+		return
+	}
+	if err := deleteResumable(db.WithContext(r.Context()), &up); err != nil {
+		slog.ErrorContext(r.Context(), "could not delete resumable upload", "error", err)
+		http.Error(w, "Could not delete upload", http.StatusInternalServerError)
+		return
+	}
+	// Anything left behind is collected with the orphaned uploads
+	removeChunks(r.Context(), up.UUID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteResumable deletes an upload along with the record of its chunks, a
+// request still storing a chunk then finds nothing to update.
+func deleteResumable(db *gorm.DB, up *models.ResumableUpload) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("resumable_upload_id = ?", up.ID).Delete(&models.ResumableChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(up).Error
+	})
+}
+
+// removeChunks removes the stored chunks of an upload, logging failures.
+func removeChunks(ctx context.Context, id string) {
+	token := ""
+	for {
+		chunks, next, err := storer(ctx).List(tusChunkPrefix(id), token, 0)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not list upload chunks", "error", err, "uploadId", id)
+			return
+		}
+		for _, c := range chunks {
+			if err := storer(ctx).Remove(c.Path); err != nil {
+				slog.ErrorContext(ctx, "could not remove upload chunk", "error", err, "path", c.Path)
+			}
+		}
+		if next == "" {
+			return
+		}
+		token = next
+	}
+}
+
+// chunkReader reads the chunks of an upload one after the other as if they
+// were a single file.
+type chunkReader struct {
+	st    storage.Storer
+	paths []string
+	cur   io.ReadCloser
+}
+
+// openChunks reads the recorded chunks of an upload, chunks stored by
+// requests that lost a race are skipped.
+func openChunks(ctx context.Context, up *models.ResumableUpload) (io.ReadCloser, error) {
+	var chunks []models.ResumableChunk
+	if err := db.WithContext(ctx).Where("resumable_upload_id = ?", up.ID).Order("start").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	cr := &chunkReader{st: storer(ctx)}
+	var offset int64
+	for _, c := range chunks {
+		if c.Start != offset {
+			return nil, fmt.Errorf("chunk at %d, expected %d", c.Start, offset)
+		}
+		cr.paths = append(cr.paths, c.Path)
+		offset += c.Size
+	}
+	return cr, nil
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.cur == nil {
+			if len(cr.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := cr.st.Open(cr.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.cur, cr.paths = f, cr.paths[1:]
+		}
+		n, err := cr.cur.Read(p)
+		if errors.Is(err, io.EOF) {
+			cr.cur.Close()
+			cr.cur, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur == nil {
+		return nil
+	}
+	return cr.cur.Close()
+}
+
+// finishError responds to a request whose upload could not be finished.
+func finishError(w http.ResponseWriter, r *http.Request, up *models.ResumableUpload, err error, msg string) {
+	switch {
+	case errors.Is(err, ErrInfected):
+		http.Error(w, "Upload rejected, the "+err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrTooLargeToScan):
+		http.Error(w, "Upload rejected, the "+err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		slog.ErrorContext(r.Context(), "could not finish resumable upload", "error", err, "uploadId", up.UUID)
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
+
+// finishResumable scans the chunks, joins them into the final file and
+// records it as an Upload of the owner. The content type is sniffed from the
+// data, like for every other upload, rather than taken from the client.
+// Flagged uploads and those too large to scan are deleted and reported with
+// ErrInfected or ErrTooLargeToScan.
+func finishResumable(ctx context.Context, up *models.ResumableUpload) error {
+	open := func() (io.ReadCloser, error) { return openChunks(ctx, up) }
+	err := scanUpload(ctx, up.OwnerID, fmt.Sprintf("resumable upload %q", up.Filename), open)
+	if errors.Is(err, ErrInfected) || errors.Is(err, ErrTooLargeToScan) {
+		if err := deleteResumable(db.WithContext(ctx), up); err != nil {
+			slog.ErrorContext(ctx, "could not delete resumable upload", "error", err)
+		}
+		removeChunks(ctx, up.UUID)
+		return err
+	} else if err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	head = head[:n]
+	// Collected with the chunks if we fail before the rename
+	joined := tusChunkPrefix(up.UUID) + "joined-" + strings.ToLower(rand.Text())
+	wc, err := storer(ctx).Create(joined)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(wc, io.MultiReader(bytes.NewReader(head), rc))
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	if written != up.Size {
+		return fmt.Errorf("joined %d bytes of %d", written, up.Size)
+	}
+	name := "files/" + up.UUID
+	if err := storer(ctx).Rename(joined, name); err != nil {
+		return err
+	}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		upload := models.Upload{
+			Path:        name,
+			OwnerID:     up.OwnerID,
+			Visibility:  models.VisibilityPrivate,
+			ContentType: http.DetectContentType(head),
+			Size:        up.Size,
+		}
+		if err := tx.Create(&upload).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&models.ResumableUpload{}).Where("id = ? AND upload_id = 0", up.ID).Update("upload_id", upload.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return errUploadFinished
+		}
+		up.UploadID = upload.ID
+		return tx.Where("resumable_upload_id = ?", up.ID).Delete(&models.ResumableChunk{}).Error
+	})
+	if errors.Is(err, errUploadFinished) {
+		// Another request recorded the same bytes first
+		return nil
+	} else if err != nil {
+		return err
+	}
+	removeChunks(ctx, up.UUID)
+	return nil
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/utils"
+	"gorm.io/gorm"
+)
+
+/* Changing the email address is the classic account takeover path: once the
+ * attacker owns the email they can reset the password. So when the email
+ * changes we tell the previous address and give them a way to revert the
+ * change. Reverting also locks the account until the password is reset
+ * because whoever changed the email likely knows the password. */
+
+// How long the previous owner has to undo an email change
+const undoEmailChangeExpiry = 72 * time.Hour
+
+func sendEmailChangeNotice(ctx context.Context, userID uint, oldEmail, newEmail string) error {
+	undoToken := models.Token{
+		UserID:    userID,
+		Email:     oldEmail,
+		Token:     utils.LinkToken(),
+		Purpose:   "undo_email_change",
+		ExpiresAt: time.Now().Add(undoEmailChangeExpiry),
+	}
+	if err := db.WithContext(ctx).Create(&undoToken).Error; err != nil {
+		slog.ErrorContext(ctx, "could not create undo email change token", "error", err)
+		return errors.New("could not create undo token")
+	}
+	emailData := map[string]any{
+		"NewEmail":  newEmail,
+		"UndoURL":   fmt.Sprintf("%s/undo-email-change?token=%s", baseURL, url.QueryEscape(undoToken.Token)),
+		"ExpiresAt": undoToken.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"),
+	}
+	return sendTemplateEmail(ctx, oldEmail, "Your email address was changed", "email_changed.txt", emailData)
+}
+
+type UndoEmailChangePage struct {
+	BasePage
+	Token      string `schema:"token"`
+	TokenError error
+	Error      error
+}
+
+func (p *UndoEmailChangePage) Validate() bool {
+	p.TokenError = ValidateToken(p.Token)
+	return p.TokenError == nil
+}
+
+func findUndoToken(ctx context.Context, token string) (models.Token, error) {
+	var t models.Token
+	if err := db.WithContext(ctx).Where("token = ?", token).
+		Where("purpose = ?", "undo_email_change").
+		Where("expires_at > ?", time.Now()).
+		First(&t).Error; err != nil {
+		slog.DebugContext(ctx, "could not find undo email change token", "error", err)
+		return t, errors.New("this link is invalid or has expired")
+	}
+	return t, nil
+}
+
+func (p *UndoEmailChangePage) Handle(w http.ResponseWriter, r *http.Request) {
+	// We don't act on GET because email clients and scanners prefetch links
+	if r.Method == http.MethodGet {
+		p.Token = r.URL.Query().Get("token")
+		if !p.Validate() {
+			p.Error = errors.New("this link is invalid or has expired")
+			return
+		}
+		if _, err := findUndoToken(r.Context(), p.Token); err != nil {
+			p.Error = err
+		}
+		return
+	}
+	// ---------------------------
+	if r.PostFormValue("_action") != "undo_email_change" {
+		p.notFound = true
+		return
+	}
+	if err := DecodeValidForm(p, r); err != nil {
+		p.Error = err
+		return
+	}
+	token, err := findUndoToken(r.Context(), p.Token)
+	if err != nil {
+		p.Error = err
+		return
+	}
+	// ---------------------------
+	err = db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", token.UserID).Updates(map[string]any{
+			"email":  token.Email,
+			"locked": true,
+		}).Error; err != nil {
+			return err
+		}
+		// Pending tokens may have been requested by the attacker
+		return tx.Where("user_id = ?", token.UserID).Delete(&models.Token{}).Error
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "could not revert email change", "error", err, "userId", token.UserID)
+		// The old address may have been taken in the meantime, we still lock
+		// the account to stop the attacker.
+		if err := db.WithContext(r.Context()).Model(&models.User{}).Where("id = ?", token.UserID).Update("locked", true).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not lock account", "error", err, "userId", token.UserID)
+		}
+		p.Error = errors.New("we locked your account but could not restore your email address, please contact support")
+		return
+	}
+	slog.WarnContext(r.Context(), "Email change reverted and account locked", "userId", token.UserID)
+	if err := auth.LogUserOut(w, r, ss); err != nil {
+		slog.ErrorContext(r.Context(), "could not log user out", "error", err)
+	}
+	// Send a reset token so the owner can unlock the account right away
+	if err := sendPasswordReset(r.Context(), token.Email); err != nil {
+		slog.ErrorContext(r.Context(), "could not send password reset after undo", "error", err)
+	}
+	p.Flash(r, FlashWarning, "Your email address has been restored and your account locked. We have sent you a token to reset your password.")
+	p.redirect = "/reset-password?email=" + url.QueryEscape(token.Email)
+}
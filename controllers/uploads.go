@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nuric/go-web-app-template/auth"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"gorm.io/gorm"
+)
+
+// UploadsHandler serves files from the Storer after checking the upload
+// metadata. Files without metadata are never served, and files the user may
+// not read are reported as not found so their existence doesn't leak.
+type UploadsHandler struct{}
+
+func canReadUpload(user models.User, u models.Upload) bool {
+	switch u.Visibility {
+	case models.VisibilityPublic:
+		return true
+	case models.VisibilityShared:
+		if user.ID != 0 && slices.ContainsFunc(u.Shares, func(s models.UploadShare) bool { return s.UserID == user.ID }) {
+			return true
+		}
+	}
+	return user.ID != 0 && user.ID == u.OwnerID
+}
+
+// signedUploadURL returns an absolute signed URL for a Storer path. Paths
+// starting with /uploads/, such as models.User.Picture, are accepted too.
+func signedUploadURL(name string, ttl time.Duration, disposition string) (string, error) {
+	name = strings.TrimPrefix(name, urlSigner.Prefix)
+	u, err := urlSigner.Sign(name, time.Now().Add(ttl), disposition)
+	if err != nil {
+		return "", err
+	}
+	return baseURL + u, nil
+}
+
+func (h UploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	if storage.IsSigned(r.URL.Query()) {
+		h.serveSigned(w, r, name)
+		return
+	}
+	user := auth.GetCurrentUser(r)
+	var upload models.Upload
+	if err := db.WithContext(r.Context()).Preload("Shares").Where("path = ?", name).First(&upload).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.ErrorContext(r.Context(), "could not load upload", "error", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if !canReadUpload(user, upload) {
+		slog.DebugContext(r.Context(), "upload access denied", "path", name, "userId", user.ID)
+		http.NotFound(w, r)
+		return
+	}
+	serveUpload(w, r, upload)
+}
+
+// serveSigned serves any Storer path with a valid signature regardless of who
+// is asking, the signature is the permission.
+func (h UploadsHandler) serveSigned(w http.ResponseWriter, r *http.Request, name string) {
+	disposition, err := urlSigner.Verify(name, r.URL.Query(), time.Now())
+	if err != nil {
+		slog.DebugContext(r.Context(), "signed url rejected", "path", name, "error", err)
+		http.Error(w, "This link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+	upload := models.Upload{Path: name, Visibility: models.VisibilityPrivate}
+	if err := db.WithContext(r.Context()).Where("path = ?", name).First(&upload).Error; err != nil {
+		// Signed URLs may point at files without metadata
+		upload.ContentType = mime.TypeByExtension(path.Ext(name))
+		if upload.ContentType == "" {
+			upload.ContentType = "application/octet-stream"
+		}
+	}
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	serveUpload(w, r, upload)
+}
+
+// serveUpload writes the file with the content type we recorded at upload time
+// rather than guessing it from the name or content.
+func serveUpload(w http.ResponseWriter, r *http.Request, upload models.Upload) {
+	f, err := storer(r.Context()).Open(upload.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.WarnContext(r.Context(), "upload metadata without file", "path", upload.Path)
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "could not open upload", "error", err)
+		http.Error(w, "could not open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", upload.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if upload.Visibility == models.VisibilityPublic {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", upload.UpdatedAt, rs)
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		slog.ErrorContext(r.Context(), "could not write upload", "error", err)
+	}
+}
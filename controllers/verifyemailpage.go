@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"log/slog"
 	"net/http"
@@ -24,7 +25,7 @@ func (p *VerifyEmailPage) Validate() bool {
 	return p.TokenError == nil
 }
 
-func sendEmailVerification(userID uint, email string) error {
+func sendEmailVerification(ctx context.Context, userID uint, email string) error {
 	newToken := models.Token{
 		UserID:    userID,
 		Email:     email,
@@ -32,31 +33,31 @@ func sendEmailVerification(userID uint, email string) error {
 		Purpose:   "email_verification",
 		ExpiresAt: time.Now().Add(15 * time.Minute),
 	}
-	if err := db.Create(&newToken).Error; err != nil {
-		slog.Error("could not create email verification token", "error", err)
+	if err := db.WithContext(ctx).Create(&newToken).Error; err != nil {
+		slog.ErrorContext(ctx, "could not create email verification token", "error", err)
 		return errors.New("could not create verification token")
 	}
 	emailData := map[string]any{
 		"Token": newToken.Token,
 	}
-	if err := sendTemplateEmail(email, "Email Verification", "verify_email.txt", emailData); err != nil {
-		slog.Error("could not send verification email", "error", err)
+	if err := sendTemplateEmail(ctx, email, "Email Verification", "verify_email.txt", emailData); err != nil {
+		slog.ErrorContext(ctx, "could not send verification email", "error", err)
 		return errors.New("could not send verification email")
 	}
 	return nil
 }
 
-func checkEmailVerification(userID uint, email string, userToken string) error {
+func checkEmailVerification(ctx context.Context, userID uint, email string, userToken string) error {
 	// Get the last token that hasn't expired
 	var token models.Token
-	if err := db.Where("user_id = ?", userID).
+	if err := db.WithContext(ctx).Where("user_id = ?", userID).
 		Where("token = ?", userToken).
 		Where("email = ?", email).
 		Where("purpose = ?", "email_verification").
 		Where("expires_at > ?", time.Now()).
 		Order("created_at DESC").
 		First(&token).Error; err != nil {
-		slog.Error("could not find valid token", "error", err)
+		slog.ErrorContext(ctx, "could not find valid token", "error", err)
 		return errors.New("invalid token or expired token")
 	}
 	// Check if the token matches
@@ -64,8 +65,8 @@ func checkEmailVerification(userID uint, email string, userToken string) error {
 		return errors.New("invalid token or expired token")
 	}
 	// Delete token as it is now considered used
-	if err := db.Delete(&token).Error; err != nil {
-		slog.Error("could not delete token after verification", "error", err)
+	if err := db.WithContext(ctx).Delete(&token).Error; err != nil {
+		slog.ErrorContext(ctx, "could not delete token after verification", "error", err)
 	}
 	return nil
 }
@@ -89,7 +90,7 @@ func (p *VerifyEmailPage) Handle(w http.ResponseWriter, r *http.Request) {
 	// ---------------------------
 	switch r.PostFormValue("_action") {
 	case "resend_verification":
-		if err := sendEmailVerification(user.ID, user.Email); err != nil {
+		if err := sendEmailVerification(r.Context(), user.ID, user.Email); err != nil {
 			p.Error = err
 			return
 		}
@@ -100,13 +101,13 @@ func (p *VerifyEmailPage) Handle(w http.ResponseWriter, r *http.Request) {
 			p.Error = err
 			return
 		}
-		if err := checkEmailVerification(user.ID, user.Email, p.Token); err != nil {
+		if err := checkEmailVerification(r.Context(), user.ID, user.Email, p.Token); err != nil {
 			p.Error = err
 			return
 		}
 		// Update the user's email verification status
-		if err := db.Model(&user).Update("email_verified", true).Error; err != nil {
-			slog.Error("could not update user email verification status", "error", err)
+		if err := db.WithContext(r.Context()).Model(&user).Update("email_verified", true).Error; err != nil {
+			slog.ErrorContext(r.Context(), "could not update user email verification status", "error", err)
 			p.Error = errors.New("could not verify email")
 			return
 		}
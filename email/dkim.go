@@ -0,0 +1,242 @@
+package email
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* DKIM (RFC 6376) lets receiving servers check that a message was sent on
+ * behalf of our domain and was not modified on the way. We hash a canonical
+ * form of the body and selected headers and sign it with a private key whose
+ * public half is published in DNS at <selector>._domainkey.<domain>. */
+
+const (
+	CanonicalizationSimple  = "simple"
+	CanonicalizationRelaxed = "relaxed"
+)
+
+// The headers we sign, if present. From is mandatory per the RFC.
+var dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIMSigner wraps an emailer and adds a DKIM-Signature header to every
+// outgoing message. The wrapped emailer must be able to send raw messages.
+type DKIMSigner struct {
+	Next     RawEmailer
+	From     string
+	Selector string
+	Domain   string
+	// Header and body canonicalization, defaults to relaxed/relaxed which
+	// survives most relays rewrapping headers.
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	Key                    crypto.Signer
+	// Now is used to set the Date header and signature timestamp. Mostly
+	// useful for tests.
+	Now func() time.Time
+}
+
+// NewDKIMSigner loads the PEM encoded private key at keyPath and returns a
+// signer sending through next. Both RSA and Ed25519 keys are supported.
+func NewDKIMSigner(next Emailer, from, selector, domain, keyPath string) (*DKIMSigner, error) {
+	raw, ok := next.(RawEmailer)
+	if !ok {
+		return nil, fmt.Errorf("emailer %T cannot send raw messages", next)
+	}
+	if selector == "" || domain == "" {
+		return nil, errors.New("dkim selector and domain are required")
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read dkim key: %w", err)
+	}
+	key, err := ParseDKIMKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" {
+		from = "noreply@" + domain
+	}
+	return &DKIMSigner{
+		Next:                   raw,
+		From:                   from,
+		Selector:               selector,
+		Domain:                 domain,
+		HeaderCanonicalization: CanonicalizationRelaxed,
+		BodyCanonicalization:   CanonicalizationRelaxed,
+		Key:                    key,
+		Now:                    time.Now,
+	}, nil
+}
+
+// ParseDKIMKey decodes a PKCS#1 or PKCS#8 private key.
+func ParseDKIMKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block found in dkim key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse dkim key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported dkim key type %T", key)
+	}
+}
+
+func (s *DKIMSigner) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *DKIMSigner) SendEmail(ctx context.Context, to string, subject string, body string) error {
+	headers, err := BuildHeaders(s.From, to, subject, s.now())
+	if err != nil {
+		return err
+	}
+	msg, err := s.Sign(WithRequestID(ctx, headers), body)
+	if err != nil {
+		return err
+	}
+	return s.Next.SendRawEmail(ctx, to, msg)
+}
+
+// Sign returns the complete message with a DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(headers []Header, body string) ([]byte, error) {
+	var algo string
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algo = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported dkim key type %T", s.Key)
+	}
+	hc, bc := s.HeaderCanonicalization, s.BodyCanonicalization
+	if hc == "" {
+		hc = CanonicalizationRelaxed
+	}
+	if bc == "" {
+		bc = CanonicalizationRelaxed
+	}
+	// ---------------------------
+	// Body hash
+	body = toCRLF(body)
+	bodyHash := sha256.Sum256([]byte(canonicalBody(body, bc)))
+	// ---------------------------
+	// Pick the headers to sign, the order in h= must match the hash input
+	var signed []Header
+	var names []string
+	for _, name := range dkimSignedHeaders {
+		for _, h := range headers {
+			if strings.EqualFold(h.Name, name) {
+				signed = append(signed, h)
+				names = append(names, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return nil, errors.New("dkim requires a From header")
+	}
+	sigValue := fmt.Sprintf("v=1; a=%s; c=%s/%s; d=%s; s=%s; t=%s; h=%s; bh=%s; b=",
+		algo, hc, bc, s.Domain, s.Selector,
+		strconv.FormatInt(s.now().Unix(), 10),
+		strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// ---------------------------
+	// Header hash, the signature header itself is included with an empty b=
+	// tag and without the trailing CRLF.
+	hash := sha256.New()
+	for _, h := range signed {
+		hash.Write([]byte(canonicalHeader(h, hc)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(Header{"DKIM-Signature", sigValue}, hc), "\r\n")))
+	digest := hash.Sum(nil)
+	var sig []byte
+	var err error
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA
+		sig = ed25519.Sign(key, digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim sign: %w", err)
+	}
+	sigHeader := Header{"DKIM-Signature", sigValue + base64.StdEncoding.EncodeToString(sig)}
+	return WriteMessage(append([]Header{sigHeader}, headers...), body), nil
+}
+
+// canonicalHeader returns the header line including the trailing CRLF.
+func canonicalHeader(h Header, method string) string {
+	if method == CanonicalizationSimple {
+		return h.Name + ": " + h.Value + "\r\n"
+	}
+	// Relaxed: lowercase name, unfold, collapse whitespace and trim
+	value := strings.ReplaceAll(h.Value, "\r\n", "")
+	value = strings.TrimSpace(collapseWSP(value))
+	return strings.ToLower(strings.TrimSpace(h.Name)) + ":" + value + "\r\n"
+}
+
+// canonicalBody expects CRLF line endings.
+func canonicalBody(body string, method string) string {
+	lines := strings.Split(body, "\r\n")
+	if method == CanonicalizationRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseWSP(line), " ")
+		}
+	}
+	// Ignore all empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if method == CanonicalizationSimple {
+			return "\r\n"
+		}
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// collapseWSP reduces every run of spaces and tabs to a single space.
+func collapseWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
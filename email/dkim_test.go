@@ -0,0 +1,187 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/nuric/go-web-app-template/requestid"
+	"github.com/stretchr/testify/require"
+)
+
+type captureEmailer struct {
+	msgs [][]byte
+}
+
+func (c *captureEmailer) SendEmail(ctx context.Context, to, subject, body string) error {
+	return nil
+}
+
+func (c *captureEmailer) SendRawEmail(ctx context.Context, to string, msg []byte) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+// verifyDKIM checks the message against the given public key without DNS.
+func verifyDKIM(t *testing.T, msg []byte, pub crypto.PublicKey) error {
+	t.Helper()
+	var record string
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		require.NoError(t, err)
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k)
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			require.Equal(t, "test._domainkey.example.com", domain)
+			return []string{record}, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	return verifications[0].Err
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		method string
+		want   string
+	}{
+		{"simple keeps everything", Header{"Subject", "Hello  \t World "}, CanonicalizationSimple, "Subject: Hello  \t World \r\n"},
+		{"relaxed lowercases name", Header{"SUBJECT", "Hello"}, CanonicalizationRelaxed, "subject:Hello\r\n"},
+		{"relaxed collapses whitespace", Header{"Subject", "  Hello  \t World  "}, CanonicalizationRelaxed, "subject:Hello World\r\n"},
+		{"relaxed unfolds", Header{"Subject", "Hello\r\n World"}, CanonicalizationRelaxed, "subject:Hello World\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, canonicalHeader(tt.header, tt.method))
+		})
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		method string
+		want   string
+	}{
+		{"simple empty", "", CanonicalizationSimple, "\r\n"},
+		{"relaxed empty", "", CanonicalizationRelaxed, ""},
+		{"simple trailing lines", "Hi\r\n\r\n\r\n", CanonicalizationSimple, "Hi\r\n"},
+		{"relaxed whitespace", " Hi  there \t\r\n\r\n", CanonicalizationRelaxed, " Hi there\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, canonicalBody(tt.body, tt.method))
+		})
+	}
+}
+
+func TestDKIMSigner_Verify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keys := map[string]crypto.Signer{"rsa": rsaKey, "ed25519": edKey}
+	methods := []string{CanonicalizationSimple, CanonicalizationRelaxed}
+	for keyName, key := range keys {
+		for _, hc := range methods {
+			for _, bc := range methods {
+				t.Run(keyName+"/"+hc+"/"+bc, func(t *testing.T) {
+					next := &captureEmailer{}
+					s := &DKIMSigner{
+						Next:                   next,
+						From:                   "noreply@example.com",
+						Selector:               "test",
+						Domain:                 "example.com",
+						HeaderCanonicalization: hc,
+						BodyCanonicalization:   bc,
+						Key:                    key,
+					}
+					ctx := requestid.NewContext(context.Background(), "req-1")
+					err := s.SendEmail(ctx, "gandalf@example.com", "You  shall\tpass", "Hello,\n\nPlease verify  your email.\n\n\n")
+					require.NoError(t, err)
+					require.Len(t, next.msgs, 1)
+					require.Contains(t, string(next.msgs[0]), "\r\nX-Request-ID: req-1\r\n")
+					require.NoError(t, verifyDKIM(t, next.msgs[0], key.Public()))
+				})
+			}
+		}
+	}
+}
+
+func TestDKIMSigner_RelaxedSurvivesRefolding(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	for _, hc := range []string{CanonicalizationSimple, CanonicalizationRelaxed} {
+		t.Run(hc, func(t *testing.T) {
+			s := &DKIMSigner{
+				From:                   "noreply@example.com",
+				Selector:               "test",
+				Domain:                 "example.com",
+				HeaderCanonicalization: hc,
+				Key:                    key,
+			}
+			headers, err := BuildHeaders(s.From, "gandalf@example.com", "A long subject line", time.Now())
+			require.NoError(t, err)
+			msg, err := s.Sign(headers, "Body\n")
+			require.NoError(t, err)
+			// Relays may fold long headers and change whitespace
+			tampered := strings.Replace(string(msg), "Subject: A long subject line", "Subject: A long\r\n  subject   line", 1)
+			err = verifyDKIM(t, []byte(tampered), key.Public())
+			if hc == CanonicalizationRelaxed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestDKIMSigner_DetectsTampering(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := &DKIMSigner{From: "noreply@example.com", Selector: "test", Domain: "example.com", Key: key}
+	headers, err := BuildHeaders(s.From, "gandalf@example.com", "Token", time.Now())
+	require.NoError(t, err)
+	msg, err := s.Sign(headers, "Your token is ABC123\n")
+	require.NoError(t, err)
+	tampered := strings.Replace(string(msg), "ABC123", "XYZ789", 1)
+	require.Error(t, verifyDKIM(t, []byte(tampered), key.Public()))
+}
+
+func TestNewDKIMSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "dkim.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+	s, err := NewDKIMSigner(LogEmailer{}, "", "test", "example.com", keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "noreply@example.com", s.From)
+
+	_, err = NewDKIMSigner(LogEmailer{}, "", "test", "example.com", filepath.Join(t.TempDir(), "missing.pem"))
+	require.Error(t, err)
+
+	_, err = NewDKIMSigner(&captureEmailer{}, "", "", "example.com", keyPath)
+	require.Error(t, err)
+}
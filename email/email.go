@@ -1,17 +1,166 @@
 package email
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"log/slog"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/nuric/go-web-app-template/requestid"
 )
 
+// Emailers receive the context of the request that sends the email so their
+// logs and messages can be traced back to it.
 type Emailer interface {
-	SendEmail(to string, subject string, body string) error
+	SendEmail(ctx context.Context, to string, subject string, body string) error
+}
+
+// RawEmailer is implemented by emailers that can deliver a fully formed RFC
+// 5322 message. Wrappers that need control over the headers, such as the DKIM
+// signer, hand their messages over through this interface.
+type RawEmailer interface {
+	SendRawEmail(ctx context.Context, to string, msg []byte) error
 }
 
 type LogEmailer struct{}
 
-func (c LogEmailer) SendEmail(to string, subject string, body string) error {
+func (c LogEmailer) SendEmail(ctx context.Context, to string, subject string, body string) error {
 	// Simulate sending email by logging it
-	slog.Debug("Sending email", "to", to, "subject", subject, "body", body)
+	slog.DebugContext(ctx, "Sending email", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+func (c LogEmailer) SendRawEmail(ctx context.Context, to string, msg []byte) error {
+	slog.DebugContext(ctx, "Sending raw email", "to", to, "message", string(msg))
 	return nil
 }
+
+// SMTPEmailer delivers messages through an SMTP relay. Authentication is
+// skipped when no username is set.
+type SMTPEmailer struct {
+	Addr     string // host:port of the relay
+	Username string
+	Password string
+	From     string
+}
+
+func (c SMTPEmailer) SendEmail(ctx context.Context, to string, subject string, body string) error {
+	headers, err := BuildHeaders(c.From, to, subject, time.Now())
+	if err != nil {
+		return err
+	}
+	return c.SendRawEmail(ctx, to, WriteMessage(WithRequestID(ctx, headers), body))
+}
+
+func (c SMTPEmailer) SendRawEmail(ctx context.Context, to string, msg []byte) error {
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, _ := strings.Cut(c.Addr, ":")
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	if err := smtp.SendMail(c.Addr, auth, c.From, []string{to}, msg); err != nil {
+		return fmt.Errorf("smtp send: %w", err)
+	}
+	return nil
+}
+
+// Header is a single message header field. We keep headers in a slice rather
+// than a map because order matters for signing.
+type Header struct {
+	Name  string
+	Value string
+}
+
+/* Header values may come from users, e.g. the address they signed up with, so
+ * a line break in one would let them add headers of their own, which the DKIM
+ * signer would then vouch for. We refuse such values rather than strip the
+ * breaks because what is left is unlikely to be what the caller meant.
+ * Non-ASCII names and subjects are encoded as RFC 2047 encoded words. */
+
+var ErrHeaderLineBreak = errors.New("header value contains a line break")
+
+// encodeAddress validates a single address and encodes its display name.
+func encodeAddress(field, value string) (*mail.Address, string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, "", fmt.Errorf("%s: %w", field, ErrHeaderLineBreak)
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", field, err)
+	}
+	if addr.Name == "" {
+		return addr, addr.Address, nil
+	}
+	return addr, addr.String(), nil
+}
+
+// BuildHeaders returns the headers of a plain text message in the order they
+// will be written.
+func BuildHeaders(from, to, subject string, date time.Time) ([]Header, error) {
+	fromAddr, fromValue, err := encodeAddress("from", from)
+	if err != nil {
+		return nil, err
+	}
+	_, toValue, err := encodeAddress("to", to)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return nil, fmt.Errorf("subject: %w", ErrHeaderLineBreak)
+	}
+	domain := "localhost"
+	if _, d, ok := strings.Cut(fromAddr.Address, "@"); ok {
+		domain = d
+	}
+	return []Header{
+		{"From", fromValue},
+		{"To", toValue},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", strings.ToLower(rand.Text()), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	}, nil
+}
+
+// WithRequestID adds the ID of the request sending the message, if any, so a
+// message can be traced back to the logs.
+func WithRequestID(ctx context.Context, headers []Header) []Header {
+	if id := requestid.FromContext(ctx); id != "" {
+		headers = append(headers, Header{requestid.Header, id})
+	}
+	return headers
+}
+
+// WriteMessage serialises headers and body with CRLF line endings.
+func WriteMessage(headers []Header, body string) []byte {
+	var buf bytes.Buffer
+	for _, h := range headers {
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(toCRLF(body))
+	return buf.Bytes()
+}
+
+// BuildMessage creates a complete plain text message ready for delivery.
+func BuildMessage(from, to, subject, body string, date time.Time) ([]byte, error) {
+	headers, err := BuildHeaders(from, to, subject, date)
+	if err != nil {
+		return nil, err
+	}
+	return WriteMessage(headers, body), nil
+}
+
+func toCRLF(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"context"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func headerValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func TestBuildHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		subject string
+		wantErr bool
+	}{
+		{"Plain", "noreply@example.com", "gandalf@example.com", "Reset your password", false},
+		{"NamedSender", "My App <noreply@example.com>", "gandalf@example.com", "Welcome", false},
+		{"UnicodeSubject", "noreply@example.com", "gandalf@example.com", "Grüße from Zürich ✓", false},
+		{"UnicodeName", "Zoë <noreply@example.com>", "gandalf@example.com", "Welcome", false},
+		{"SubjectInjection", "noreply@example.com", "gandalf@example.com", "Hi\r\nBcc: mallory@example.com", true},
+		{"SubjectLineFeed", "noreply@example.com", "gandalf@example.com", "Hi\nBcc: mallory@example.com", true},
+		{"ToInjection", "noreply@example.com", "gandalf@example.com\r\nBcc: mallory@example.com", "Hi", true},
+		{"FromInjection", "Evil\r\nBcc: mallory@example.com <noreply@example.com>", "gandalf@example.com", "Hi", true},
+		{"InvalidTo", "noreply@example.com", "not an address", "Hi", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, err := BuildHeaders(tt.from, tt.to, tt.subject, time.Now())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, h := range headers {
+				require.NotContains(t, h.Value, "\r", h.Name)
+				require.NotContains(t, h.Value, "\n", h.Name)
+				// Header values must be ASCII, anything else is encoded
+				for _, c := range h.Value {
+					require.Less(t, c, rune(0x80), h.Name)
+				}
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(headerValue(headers, "Subject"))
+			require.NoError(t, err)
+			require.Equal(t, tt.subject, subject)
+			from, err := mail.ParseAddress(headerValue(headers, "From"))
+			require.NoError(t, err)
+			want, err := mail.ParseAddress(tt.from)
+			require.NoError(t, err)
+			require.Equal(t, want, from)
+			require.True(t, strings.HasSuffix(headerValue(headers, "Message-ID"), "@example.com>"))
+		})
+	}
+}
+
+func TestDKIMSigner_RejectsInjection(t *testing.T) {
+	s := &DKIMSigner{From: "noreply@example.com", Next: LogEmailer{}}
+	err := s.SendEmail(context.Background(), "gandalf@example.com", "Hi\r\nBcc: mallory@example.com", "Body")
+	require.ErrorIs(t, err, ErrHeaderLineBreak)
+}
@@ -0,0 +1,73 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nuric/go-web-app-template/models"
+	"gorm.io/gorm"
+)
+
+// ErrSuppressed is returned when sending to an address on the suppression
+// list. Sending to it would only hurt our sender reputation further.
+var ErrSuppressed = errors.New("recipient address is suppressed")
+
+type SuppressionList interface {
+	IsSuppressed(address string) (bool, error)
+}
+
+// DBSuppressionList looks up suppressions in the database.
+type DBSuppressionList struct {
+	DB *gorm.DB
+}
+
+func (l DBSuppressionList) IsSuppressed(address string) (bool, error) {
+	var count int64
+	if err := l.DB.Model(&models.Suppression{}).Where("email = ?", NormaliseAddress(address)).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("check suppression: %w", err)
+	}
+	return count > 0, nil
+}
+
+// SuppressingEmailer refuses to send to suppressed addresses and otherwise
+// passes messages to the next emailer.
+type SuppressingEmailer struct {
+	Next Emailer
+	List SuppressionList
+}
+
+func (s SuppressingEmailer) check(to string) error {
+	suppressed, err := s.List.IsSuppressed(to)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return fmt.Errorf("%w: %s", ErrSuppressed, to)
+	}
+	return nil
+}
+
+func (s SuppressingEmailer) SendEmail(ctx context.Context, to string, subject string, body string) error {
+	if err := s.check(to); err != nil {
+		return err
+	}
+	return s.Next.SendEmail(ctx, to, subject, body)
+}
+
+func (s SuppressingEmailer) SendRawEmail(ctx context.Context, to string, msg []byte) error {
+	raw, ok := s.Next.(RawEmailer)
+	if !ok {
+		return fmt.Errorf("emailer %T cannot send raw messages", s.Next)
+	}
+	if err := s.check(to); err != nil {
+		return err
+	}
+	return raw.SendRawEmail(ctx, to, msg)
+}
+
+// NormaliseAddress is used so suppressions match regardless of case.
+func NormaliseAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
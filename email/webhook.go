@@ -0,0 +1,189 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Email providers notify us when a message bounces or the recipient marks it
+ * as spam. Each provider has its own JSON format and way of signing the
+ * request, so we normalise them into events here and leave storing them to
+ * the caller. */
+
+const (
+	EventBounce    = "bounce"
+	EventComplaint = "complaint"
+)
+
+// ErrInvalidSignature is returned when a webhook request cannot be
+// authenticated.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// How old a signed webhook timestamp can be before we treat it as a replay.
+const webhookMaxAge = 5 * time.Minute
+
+// Event is a bounce or complaint notification for a single recipient.
+type Event struct {
+	Email  string
+	Type   string // EventBounce or EventComplaint
+	Detail string
+}
+
+type WebhookParser interface {
+	// Parse verifies the signature of the request and extracts the events
+	// that should suppress future emails. Events that do not affect
+	// deliverability, such as temporary failures, are skipped.
+	Parse(r *http.Request, body []byte) ([]Event, error)
+}
+
+// ---------------------------
+
+// MailgunWebhook handles Mailgun event webhooks which carry an HMAC signature
+// inside the JSON body.
+// https://documentation.mailgun.com/docs/mailgun/user-manual/tracking-messages/#securing-webhooks
+type MailgunWebhook struct {
+	SigningKey string
+	Now        func() time.Time
+}
+
+type mailgunPayload struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event          string `json:"event"`
+		Severity       string `json:"severity"`
+		Recipient      string `json:"recipient"`
+		Reason         string `json:"reason"`
+		DeliveryStatus struct {
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+func (m MailgunWebhook) Parse(r *http.Request, body []byte) ([]Event, error) {
+	var p mailgunPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("decode mailgun payload: %w", err)
+	}
+	// ---------------------------
+	sig := p.Signature
+	mac := hmac.New(sha256.New, []byte(m.SigningKey))
+	mac.Write([]byte(sig.Timestamp + sig.Token))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if m.SigningKey == "" || !hmac.Equal([]byte(expected), []byte(sig.Signature)) {
+		return nil, ErrInvalidSignature
+	}
+	if err := checkTimestamp(sig.Timestamp, m.Now); err != nil {
+		return nil, err
+	}
+	// ---------------------------
+	ed := p.EventData
+	switch {
+	case ed.Event == "failed" && ed.Severity == "permanent":
+		detail := ed.DeliveryStatus.Description
+		if detail == "" {
+			detail = ed.Reason
+		}
+		return []Event{{Email: ed.Recipient, Type: EventBounce, Detail: detail}}, nil
+	case ed.Event == "complained":
+		return []Event{{Email: ed.Recipient, Type: EventComplaint}}, nil
+	}
+	return nil, nil
+}
+
+// ---------------------------
+
+// SendGridWebhook handles SendGrid signed event webhooks. SendGrid signs the
+// timestamp and raw body with ECDSA and gives us the public key.
+// https://www.twilio.com/docs/sendgrid/for-developers/tracking-events/getting-started-event-webhook-security-features
+type SendGridWebhook struct {
+	PublicKey *ecdsa.PublicKey
+	Now       func() time.Time
+}
+
+// NewSendGridWebhook parses the base64 encoded verification key shown in the
+// SendGrid settings.
+func NewSendGridWebhook(publicKey string) (*SendGridWebhook, error) {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode sendgrid public key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse sendgrid public key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sendgrid public key is %T, expected ECDSA", key)
+	}
+	return &SendGridWebhook{PublicKey: ecKey}, nil
+}
+
+type sendGridEvent struct {
+	Email  string `json:"email"`
+	Event  string `json:"event"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (s SendGridWebhook) Parse(r *http.Request, body []byte) ([]Event, error) {
+	timestamp := r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp")
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"))
+	if err != nil || s.PublicKey == nil {
+		return nil, ErrInvalidSignature
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(s.PublicKey, digest[:], sig) {
+		return nil, ErrInvalidSignature
+	}
+	if err := checkTimestamp(timestamp, s.Now); err != nil {
+		return nil, err
+	}
+	// ---------------------------
+	var payload []sendGridEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("decode sendgrid payload: %w", err)
+	}
+	var events []Event
+	for _, e := range payload {
+		switch {
+		// Blocked bounces are usually temporary reputation issues
+		case e.Event == "bounce" && e.Type != "blocked":
+			events = append(events, Event{Email: e.Email, Type: EventBounce, Detail: e.Reason})
+		case e.Event == "spamreport":
+			events = append(events, Event{Email: e.Email, Type: EventComplaint})
+		}
+	}
+	return events, nil
+}
+
+// ---------------------------
+
+func checkTimestamp(ts string, now func() time.Time) error {
+	if now == nil {
+		now = time.Now
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(ts), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	age := now().Sub(time.Unix(secs, 0))
+	if age > webhookMaxAge || age < -webhookMaxAge {
+		return fmt.Errorf("%w: timestamp outside allowed window", ErrInvalidSignature)
+	}
+	return nil
+}
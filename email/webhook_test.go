@@ -0,0 +1,110 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func mailgunBody(key, timestamp, event, severity string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "token123"))
+	sig := hex.EncodeToString(mac.Sum(nil))
+	return fmt.Appendf(nil, `{"signature":{"timestamp":%q,"token":"token123","signature":%q},
+		"event-data":{"event":%q,"severity":%q,"recipient":"gandalf@example.com","delivery-status":{"description":"No such user"}}}`,
+		timestamp, sig, event, severity)
+}
+
+func TestMailgunWebhook(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name    string
+		body    []byte
+		want    []Event
+		wantErr error
+	}{
+		{"permanent bounce", mailgunBody("secret", now, "failed", "permanent"), []Event{{"gandalf@example.com", EventBounce, "No such user"}}, nil},
+		{"temporary bounce", mailgunBody("secret", now, "failed", "temporary"), nil, nil},
+		{"complaint", mailgunBody("secret", now, "complained", ""), []Event{{"gandalf@example.com", EventComplaint, ""}}, nil},
+		{"wrong key", mailgunBody("wrong", now, "failed", "permanent"), nil, ErrInvalidSignature},
+		{"replayed", mailgunBody("secret", old, "failed", "permanent"), nil, ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhooks/email/mailgun", nil)
+			events, err := MailgunWebhook{SigningKey: "secret"}.Parse(r, tt.body)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, events)
+		})
+	}
+}
+
+func TestSendGridWebhook(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	wh, err := NewSendGridWebhook(base64.StdEncoding.EncodeToString(der))
+	require.NoError(t, err)
+
+	body := []byte(`[{"email":"a@example.com","event":"bounce","type":"bounce","reason":"550 unknown"},
+		{"email":"b@example.com","event":"bounce","type":"blocked"},
+		{"email":"c@example.com","event":"spamreport"},
+		{"email":"d@example.com","event":"delivered"}]`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/webhooks/email/sendgrid", nil)
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	events, err := wh.Parse(r, body)
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{"a@example.com", EventBounce, "550 unknown"},
+		{"c@example.com", EventComplaint, ""},
+	}, events)
+
+	// Any change to the body invalidates the signature
+	_, err = wh.Parse(r, append(body, ' '))
+	require.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestSuppressingEmailer(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Suppression{}))
+	require.NoError(t, db.Create(&models.Suppression{Email: "bounced@example.com", Reason: EventBounce}).Error)
+
+	next := &captureEmailer{}
+	s := SuppressingEmailer{Next: LogEmailer{}, List: DBSuppressionList{DB: db}}
+	require.ErrorIs(t, s.SendEmail(context.Background(), "Bounced@Example.com", "Hi", "Body"), ErrSuppressed)
+	require.NoError(t, s.SendEmail(context.Background(), "fine@example.com", "Hi", "Body"))
+
+	s.Next = next
+	require.ErrorIs(t, s.SendRawEmail(context.Background(), "bounced@example.com", []byte("msg")), ErrSuppressed)
+	require.NoError(t, s.SendRawEmail(context.Background(), "fine@example.com", []byte("msg")))
+	require.Len(t, next.msgs, 1)
+}
@@ -0,0 +1,97 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+/* We only need a coarse location to tell users where a login came from, so
+ * instead of pulling in a MaxMind reader we load a free offline CSV database
+ * of IP ranges such as DB-IP Lite (https://db-ip.com/db/lite.php). Each row is
+ * start_ip,end_ip,location and any further columns are ignored. */
+
+type ipRange struct {
+	start    netip.Addr
+	end      netip.Addr
+	location string
+}
+
+// DB is an in-memory range database. A nil DB is valid and knows nothing.
+type DB struct {
+	ranges []ipRange
+}
+
+// Open loads a CSV range database from disk.
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %w", err)
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load parses a CSV range database.
+func Load(r io.Reader) (*DB, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	db := &DB{}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read geoip database: %w", err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("geoip database line %d: expected at least 3 columns", line)
+		}
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("geoip database line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("geoip database line %d: %w", line, err)
+		}
+		if end.Less(start) {
+			return nil, fmt.Errorf("geoip database line %d: range end before start", line)
+		}
+		db.ranges = append(db.ranges, ipRange{start: start.Unmap(), end: end.Unmap(), location: strings.TrimSpace(record[2])})
+	}
+	slices.SortFunc(db.ranges, func(a, b ipRange) int {
+		return a.start.Compare(b.start)
+	})
+	return db, nil
+}
+
+// Lookup returns the location of the address or an empty string if unknown.
+func (db *DB) Lookup(addr netip.Addr) string {
+	if db == nil || !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+	// Find the last range starting at or before the address
+	i, found := slices.BinarySearchFunc(db.ranges, addr, func(r ipRange, a netip.Addr) int {
+		return r.start.Compare(a)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 {
+		return ""
+	}
+	r := db.ranges[i]
+	if addr.BitLen() != r.end.BitLen() || r.end.Less(addr) {
+		return ""
+	}
+	return r.location
+}
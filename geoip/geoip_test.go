@@ -0,0 +1,46 @@
+package geoip
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	csv := `10.0.0.0,10.0.0.255,GB
+1.0.0.0,1.0.0.255,AU
+2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,NL
+`
+	db, err := Load(strings.NewReader(csv))
+	require.NoError(t, err)
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.0.1", "AU"},
+		{"10.0.0.0", "GB"},
+		{"10.0.0.255", "GB"},
+		{"10.0.1.0", ""},
+		{"0.0.0.1", ""},
+		{"::ffff:10.0.0.7", "GB"},
+		{"2001:db8::1", "NL"},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			require.Equal(t, tt.want, db.Lookup(netip.MustParseAddr(tt.ip)))
+		})
+	}
+	// A nil database is valid and knows nothing
+	var empty *DB
+	require.Equal(t, "", empty.Lookup(netip.MustParseAddr("1.0.0.1")))
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	_, err := Load(strings.NewReader("10.0.0.255,10.0.0.0,GB\n"))
+	require.Error(t, err)
+	_, err = Load(strings.NewReader("nope,10.0.0.0,GB\n"))
+	require.Error(t, err)
+}
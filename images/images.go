@@ -0,0 +1,151 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+/* Uploaded images are never stored as they arrive. We sniff what the bytes
+ * really are, check the dimensions in the header before decoding anything so
+ * a small file can't claim to be a gigantic image, and then decode and
+ * re-encode. Re-encoding only keeps the pixels, which strips EXIF including
+ * GPS location, comments and anything else hidden in the file. */
+
+var (
+	ErrNotImage = errors.New("file is not a supported image")
+	ErrTooLarge = errors.New("image dimensions are too large")
+)
+
+// Limits checked against the image header before decoding. A decoded image
+// takes 4 bytes per pixel regardless of how small the file is.
+const (
+	MaxDimension = 8192
+	MaxPixels    = 24_000_000
+)
+
+type format struct {
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// Keyed by the content type http.DetectContentType reports
+var formats = map[string]format{
+	"image/jpeg": {jpeg.Decode, jpeg.DecodeConfig},
+	"image/png":  {png.Decode, png.DecodeConfig},
+	"image/gif":  {gif.Decode, gif.DecodeConfig},
+	"image/webp": {webp.Decode, webp.DecodeConfig},
+}
+
+// Thumbnail is a square, re-encoded version of an image.
+type Thumbnail struct {
+	// Size that was requested, the image itself is never scaled up so it may
+	// be smaller for small originals
+	Size        int
+	ContentType string
+	Ext         string // e.g. .jpg
+	Data        []byte
+}
+
+// Thumbnails decodes data, crops it to a centred square and encodes one
+// thumbnail per size. JPEGs stay JPEGs, everything else becomes a PNG to keep
+// transparency.
+func Thumbnails(data []byte, sizes ...int) ([]Thumbnail, error) {
+	contentType := http.DetectContentType(data)
+	f, ok := formats[contentType]
+	if !ok {
+		return nil, ErrNotImage
+	}
+	cfg, err := f.decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrNotImage
+	}
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	src, err := f.decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = exifOrientation(data)
+	}
+	square := centreSquare(src.Bounds())
+	thumbs := make([]Thumbnail, 0, len(sizes))
+	for _, size := range sizes {
+		side := min(size, square.Dx())
+		dst := image.NewRGBA(image.Rect(0, 0, side, side))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, square, draw.Src, nil)
+		// Cropping to the centre and scaling don't depend on the rotation so
+		// we orient the much smaller result
+		dst = orient(dst, orientation)
+		t := Thumbnail{Size: size}
+		var buf bytes.Buffer
+		if contentType == "image/jpeg" {
+			t.ContentType, t.Ext = "image/jpeg", ".jpg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		} else {
+			t.ContentType, t.Ext = "image/png", ".png"
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Data = buf.Bytes()
+		thumbs = append(thumbs, t)
+	}
+	return thumbs, nil
+}
+
+func centreSquare(b image.Rectangle) image.Rectangle {
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// orient applies an EXIF orientation to a square image so it displays upright.
+// https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	n := img.Bounds().Dx()
+	dst := image.NewRGBA(img.Bounds())
+	for y := range n {
+		for x := range n {
+			// Where the pixel at x, y of the upright image comes from
+			sx, sy := x, y
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx = n - 1 - x
+			case 3: // Rotated 180
+				sx, sy = n-1-x, n-1-y
+			case 4: // Mirrored vertically
+				sy = n - 1 - y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Needs rotating 90 clockwise
+				sx, sy = y, n-1-x
+			case 7: // Transversed
+				sx, sy = n-1-y, n-1-x
+			case 8: // Needs rotating 90 counter clockwise
+				sx, sy = n-1-y, x
+			}
+			dst.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
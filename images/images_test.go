@@ -0,0 +1,162 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	red  = color.RGBA{255, 0, 0, 255}
+	blue = color.RGBA{0, 0, 255, 255}
+)
+
+// halves returns an image with a red top half and blue bottom half.
+func halves(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := red
+			if y >= h/2 {
+				c = blue
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, ext string, img image.Image) []byte {
+	var buf bytes.Buffer
+	switch ext {
+	case "png":
+		require.NoError(t, png.Encode(&buf, img))
+	case "jpg":
+		require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}))
+	case "gif":
+		require.NoError(t, gif.Encode(&buf, img, nil))
+	}
+	return buf.Bytes()
+}
+
+// withExif inserts an APP1 segment with the orientation tag and a GPS-like
+// marker string after the start of image marker of a JPEG.
+func withExif(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // One IFD entry
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // Value padding and no next IFD
+	tiff = append(tiff, "GPS 51.5074N 0.1278W"...)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, app1...)
+	return append(out, jpg[2:]...)
+}
+
+// pngHeader returns a PNG that is only a valid signature and header chunk
+// claiming the given dimensions, the shape of a decompression bomb.
+func pngHeader(w, h uint32) []byte {
+	out := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(ihdr)-4))
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestThumbnails(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		sizes       []int
+		wantSides   []int
+		contentType string
+	}{
+		{"png landscape", encode(t, "png", halves(300, 200)), []int{128, 64}, []int{128, 64}, "image/png"},
+		{"jpeg portrait", encode(t, "jpg", halves(200, 300)), []int{128}, []int{128}, "image/jpeg"},
+		{"gif becomes png", encode(t, "gif", halves(100, 100)), []int{64}, []int{64}, "image/png"},
+		{"never scales up", encode(t, "png", halves(50, 40)), []int{512, 32}, []int{40, 32}, "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thumbs, err := Thumbnails(tt.data, tt.sizes...)
+			require.NoError(t, err)
+			require.Len(t, thumbs, len(tt.sizes))
+			for i, thumb := range thumbs {
+				require.Equal(t, tt.sizes[i], thumb.Size)
+				require.Equal(t, tt.contentType, thumb.ContentType)
+				img, format, err := image.Decode(bytes.NewReader(thumb.Data))
+				require.NoError(t, err)
+				require.Equal(t, tt.contentType, "image/"+format)
+				require.Equal(t, image.Rect(0, 0, tt.wantSides[i], tt.wantSides[i]), img.Bounds())
+			}
+		})
+	}
+}
+
+func TestThumbnails_Rejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"text", []byte("<html><script>alert(1)</script></html>"), ErrNotImage},
+		{"empty", nil, ErrNotImage},
+		{"truncated png", encode(t, "png", halves(10, 10))[:40], ErrNotImage},
+		{"too wide", pngHeader(MaxDimension+1, 1), ErrTooLarge},
+		{"too many pixels", pngHeader(MaxDimension, MaxDimension), ErrTooLarge},
+		{"bomb", pngHeader(100000, 100000), ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Thumbnails(tt.data, 64)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestThumbnails_Exif(t *testing.T) {
+	tests := []struct {
+		orientation uint16
+		// Colours at the middle of the left and right edges once upright
+		left, right color.RGBA
+	}{
+		{6, blue, red}, // Rotating clockwise puts the top on the right
+		{8, red, blue}, // Counter clockwise puts the top on the left
+	}
+	for _, tt := range tests {
+		data := withExif(encode(t, "jpg", halves(64, 64)), tt.orientation)
+		require.Equal(t, int(tt.orientation), exifOrientation(data))
+		thumbs, err := Thumbnails(data, 64)
+		require.NoError(t, err)
+		out := thumbs[0].Data
+		require.NotContains(t, string(out), "Exif")
+		require.NotContains(t, string(out), "GPS")
+		require.Equal(t, 1, exifOrientation(out))
+
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		require.NoError(t, err)
+		near := func(c color.Color, want color.RGBA) bool {
+			r, g, b, _ := c.RGBA()
+			return (r>>8 > 200) == (want.R == 255) && g>>8 < 50 && (b>>8 > 200) == (want.B == 255)
+		}
+		require.True(t, near(img.At(4, 32), tt.left), "orientation %d left %v", tt.orientation, img.At(4, 32))
+		require.True(t, near(img.At(60, 32), tt.right), "orientation %d right %v", tt.orientation, img.At(60, 32))
+	}
+}
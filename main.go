@@ -17,9 +17,15 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/nuric/go-web-app-template/controllers"
 	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/geoip"
+	"github.com/nuric/go-web-app-template/metrics"
 	"github.com/nuric/go-web-app-template/middleware"
 	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/requestid"
+	"github.com/nuric/go-web-app-template/scan"
 	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/tracing"
+	"github.com/nuric/go-web-app-template/uploads"
 	"github.com/nuric/go-web-app-template/utils"
 	"gorm.io/gorm"
 )
@@ -31,7 +37,67 @@ type Config struct {
 	DBUrl           string `env:"DB_URL" envDefault:"data.db"`
 	SessionSecret   string `env:"SESSION_SECRET" envDefault:"32-character-long-secret-key-abc"`
 	CSRFSecret      string `env:"CSRF_SECRET" envDefault:"32-character-long-csrf-secret-key-xyz"`
+	URLSecret       string `env:"URL_SIGNING_SECRET" envDefault:"32-character-long-url-secret-key-123"`
 	DataFolder      string `env:"DATA_FOLDER" envDefault:"data"`
+	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080"`
+	GeoIPPath       string `env:"GEOIP_DB_PATH"`
+	EmailFrom       string `env:"EMAIL_FROM" envDefault:"noreply@localhost"`
+	SMTPAddr        string `env:"SMTP_ADDR"`
+	SMTPUsername    string `env:"SMTP_USERNAME"`
+	SMTPPassword    string `env:"SMTP_PASSWORD"`
+	DKIMSelector    string `env:"DKIM_SELECTOR"`
+	DKIMDomain      string `env:"DKIM_DOMAIN"`
+	DKIMKeyPath     string `env:"DKIM_KEY_PATH"`
+	// Bounce and complaint webhooks are only enabled when configured
+	MailgunWebhookKey  string `env:"MAILGUN_WEBHOOK_KEY"`
+	SendGridWebhookKey string `env:"SENDGRID_WEBHOOK_PUBLIC_KEY"`
+	// Uploads go to S3 compatible storage when a bucket is set, otherwise to
+	// the data folder
+	S3Endpoint  string `env:"S3_ENDPOINT" envDefault:"https://s3.amazonaws.com"`
+	S3Region    string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3Bucket    string `env:"S3_BUCKET"`
+	S3AccessKey string `env:"S3_ACCESS_KEY"`
+	S3SecretKey string `env:"S3_SECRET_KEY"`
+	S3PathStyle bool   `env:"S3_PATH_STYLE" envDefault:"false"`
+	// Orphaned uploads are removed periodically. By default it is a dry run
+	// that only logs them, check the logs before setting it to false.
+	UploadGCInterval time.Duration `env:"UPLOAD_GC_INTERVAL" envDefault:"24h"`
+	UploadGCGrace    time.Duration `env:"UPLOAD_GC_GRACE" envDefault:"24h"`
+	UploadGCDryRun   bool          `env:"UPLOAD_GC_DRY_RUN" envDefault:"true"`
+	// Most bytes a user can have in incomplete resumable uploads, 100MB
+	UploadLimit int64 `env:"UPLOAD_LIMIT" envDefault:"104857600"`
+	// Storage quota per role in bytes, 1GB for basic users and none for
+	// admins. Roles that are not listed are unlimited.
+	StorageQuotas map[string]int64 `env:"STORAGE_QUOTAS" envDefault:"basic:1073741824"`
+	// ClamAV daemon to scan uploads with, e.g. tcp and localhost:3310
+	ClamdNetwork string `env:"CLAMD_NETWORK" envDefault:"tcp"`
+	ClamdAddr    string `env:"CLAMD_ADDR"`
+	// Must match StreamMaxLength in clamd.conf, 25MB by default. Larger
+	// uploads can't be scanned so UPLOAD_LIMIT is lowered to it, raise both
+	// to accept larger uploads. Setting CLAMD_ALLOW_UNSCANNED keeps
+	// UPLOAD_LIMIT and stores larger uploads unscanned, recording each in the
+	// audit log.
+	ClamdMaxSize        int64 `env:"CLAMD_MAX_SIZE" envDefault:"26214400"`
+	ClamdAllowUnscanned bool  `env:"CLAMD_ALLOW_UNSCANNED" envDefault:"false"`
+	// Proxies in front of the application as CIDRs or addresses, e.g.
+	// 10.0.0.0/8. Forwarding headers are ignored unless they come from one.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+	// Log a fraction of ordinary requests, errors and slow requests are
+	// always logged
+	AccessLogSampleRate float64       `env:"ACCESS_LOG_SAMPLE_RATE" envDefault:"1"`
+	AccessLogSlow       time.Duration `env:"ACCESS_LOG_SLOW" envDefault:"1s"`
+	// Where rate limits are kept: memory, sql or redis. Replicas must share
+	// a sql or redis store.
+	RateLimitStore string `env:"RATE_LIMIT_STORE" envDefault:"memory"`
+	RedisAddr      string `env:"REDIS_ADDR" envDefault:"localhost:6379"`
+	RedisPassword  string `env:"REDIS_PASSWORD"`
+	// Metrics are served on their own port, only when a token is set which
+	// scrapers send as Authorization: Bearer <token>
+	AdminPort    int    `env:"ADMIN_PORT" envDefault:"9090"`
+	MetricsToken string `env:"METRICS_TOKEN"`
+	// Where traces go: otlp, stdout or empty to disable tracing. The OTLP
+	// endpoint is set with OTEL_EXPORTER_OTLP_ENDPOINT.
+	TraceExporter string `env:"TRACE_EXPORTER"`
 }
 
 func main() {
@@ -49,17 +115,24 @@ func main() {
 	if cfg.Debug {
 		logLevel = slog.LevelDebug
 	}
+	var logHandler slog.Handler = slog.NewJSONHandler(os.Stdout, nil)
 	if cfg.PrettyLogOutput {
 		// Set global logger with custom options
-		slog.SetDefault(slog.New(
-			tint.NewHandler(os.Stdout, &tint.Options{
-				Level:      logLevel,
-				TimeFormat: time.Kitchen,
-			}),
-		))
-	} else {
-		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+		logHandler = tint.NewHandler(os.Stdout, &tint.Options{
+			Level:      logLevel,
+			TimeFormat: time.Kitchen,
+		})
 	}
+	// Records logged with a request context carry its request ID
+	slog.SetDefault(slog.New(requestid.LogHandler{Handler: logHandler}))
+	// ---------------------------
+	// Setup tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TraceExporter, "go-web-app-template")
+	if err != nil {
+		slog.Error("Failed to setup tracing", "error", err)
+		os.Exit(1)
+	}
+	tracingEnabled := cfg.TraceExporter != ""
 	// ---------------------------
 	// Setup database connection
 	db, err := gorm.Open(sqlite.Open(cfg.DBUrl), &gorm.Config{})
@@ -67,10 +140,120 @@ func main() {
 		slog.Error("Failed to connect to database", "error", err)
 		os.Exit(1)
 	}
-	if err := db.AutoMigrate(&models.User{}, &models.Token{}); err != nil {
+	if err := db.AutoMigrate(
+		&models.User{}, &models.Token{}, &models.Suppression{}, &models.KnownDevice{},
+		&models.Upload{}, &models.UploadShare{}, &models.ResumableUpload{}, &models.ResumableChunk{}, &models.AuditEvent{},
+		&models.RateLimitBucket{},
+	); err != nil {
 		slog.Error("Failed to auto-migrate database", "error", err)
 		os.Exit(1)
 	}
+	if tracingEnabled {
+		if err := db.Use(tracing.GormPlugin{}); err != nil {
+			slog.Error("Failed to setup database tracing", "error", err)
+			os.Exit(1)
+		}
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		slog.Error("Failed to get database handle", "error", err)
+		os.Exit(1)
+	}
+	metrics.RegisterDBStats(metrics.Default, sqlDB)
+	// ---------------------------
+	// Setup email, by default we only log emails
+	var emailer email.Emailer = email.LogEmailer{}
+	if cfg.SMTPAddr != "" {
+		emailer = email.SMTPEmailer{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.EmailFrom,
+		}
+	}
+	if cfg.DKIMKeyPath != "" {
+		signer, err := email.NewDKIMSigner(emailer, cfg.EmailFrom, cfg.DKIMSelector, cfg.DKIMDomain, cfg.DKIMKeyPath)
+		if err != nil {
+			slog.Error("Failed to setup DKIM signing", "error", err)
+			os.Exit(1)
+		}
+		emailer = signer
+	}
+	emailer = email.SuppressingEmailer{Next: emailer, List: email.DBSuppressionList{DB: db}}
+	if tracingEnabled {
+		emailer = tracing.Emailer{Next: emailer}
+	}
+	webhooks := make(map[string]email.WebhookParser)
+	if cfg.MailgunWebhookKey != "" {
+		webhooks["mailgun"] = email.MailgunWebhook{SigningKey: cfg.MailgunWebhookKey}
+	}
+	if cfg.SendGridWebhookKey != "" {
+		sg, err := email.NewSendGridWebhook(cfg.SendGridWebhookKey)
+		if err != nil {
+			slog.Error("Failed to setup SendGrid webhook", "error", err)
+			os.Exit(1)
+		}
+		webhooks["sendgrid"] = sg
+	}
+	// ---------------------------
+	// Optional GeoIP database for login alerts
+	var geo *geoip.DB
+	if cfg.GeoIPPath != "" {
+		if geo, err = geoip.Open(cfg.GeoIPPath); err != nil {
+			slog.Error("Failed to load GeoIP database", "error", err)
+			os.Exit(1)
+		}
+	}
+	// ---------------------------
+	// Setup file storage
+	var storer storage.Storer = storage.OsStorer{Path: cfg.DataFolder}
+	switch {
+	case cfg.DataFolder == ":memory:":
+		// Like the database, useful for throw away environments
+		storer = &storage.MemStorer{}
+	case cfg.S3Bucket != "":
+		storer = storage.S3Storer{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		}
+	}
+	if tracingEnabled {
+		storer = tracing.Storer{Storer: storer}
+	}
+	// Uploads are only scanned if a scanner is configured
+	var scanner scan.Scanner = scan.NopScanner{}
+	if cfg.ClamdAddr != "" {
+		scanner = scan.ClamdScanner{Network: cfg.ClamdNetwork, Address: cfg.ClamdAddr, MaxSize: cfg.ClamdMaxSize}
+		if cfg.UploadLimit > cfg.ClamdMaxSize {
+			if cfg.ClamdAllowUnscanned {
+				slog.Warn("Uploads larger than the scanner accepts are stored unscanned", "uploadLimit", cfg.UploadLimit, "clamdMaxSize", cfg.ClamdMaxSize)
+			} else {
+				slog.Warn("Lowering the upload limit to what the scanner accepts", "uploadLimit", cfg.UploadLimit, "clamdMaxSize", cfg.ClamdMaxSize)
+				cfg.UploadLimit = cfg.ClamdMaxSize
+			}
+		}
+	}
+	// Pictures from before uploads were recorded would not be served otherwise
+	if n, err := uploads.BackfillPictures(context.Background(), db, storer); err != nil {
+		slog.Error("Failed to backfill profile picture uploads", "error", err)
+		os.Exit(1)
+	} else if n > 0 {
+		slog.Info("Backfilled profile picture uploads", "count", n)
+	}
+	// Periodically remove orphaned uploads
+	gcCtx, stopGC := context.WithCancel(context.Background())
+	gc := uploads.GC{DB: db, Storer: storer, GracePeriod: cfg.UploadGCGrace, DryRun: cfg.UploadGCDryRun}
+	go gc.Start(gcCtx, cfg.UploadGCInterval)
+	// ---------------------------
+	// Client addresses are used for rate limiting, logs and login alerts
+	if err := middleware.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		slog.Error("Failed to parse trusted proxies", "error", err)
+		os.Exit(1)
+	}
 	// ---------------------------
 	// Our routes
 	ss := sessions.NewCookieStore([]byte(cfg.SessionSecret))
@@ -78,19 +261,50 @@ func main() {
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		utils.Encode(w, http.StatusOK, map[string]string{"status": "ok"})
 	})
+	// Each route group has its own policy, see controllers/ratelimit.go
+	var limitStore middleware.LimiterStore
+	switch cfg.RateLimitStore {
+	case "memory":
+		limitStore = &middleware.MemoryLimiterStore{}
+	case "sql":
+		limitStore = middleware.SQLLimiterStore{DB: db}
+	case "redis":
+		limitStore = &middleware.RedisLimiterStore{Addr: cfg.RedisAddr, Password: cfg.RedisPassword}
+	default:
+		slog.Error("Unknown rate limit store", "store", cfg.RateLimitStore)
+		os.Exit(1)
+	}
+	limiter := middleware.NewRateLimiter(limitStore, 15*time.Minute)
 	config := controllers.Config{
-		Mux:        mux,
-		Database:   db,
-		Session:    ss,
-		Emailer:    email.LogEmailer{},
-		Storer:     storage.OsStorer{Path: cfg.DataFolder},
-		CSRFSecret: cfg.CSRFSecret,
-		Debug:      cfg.Debug,
+		Mux:            mux,
+		Database:       db,
+		Session:        ss,
+		Emailer:        emailer,
+		Storer:         storer,
+		CSRFSecret:     cfg.CSRFSecret,
+		URLSecret:      cfg.URLSecret,
+		Debug:          cfg.Debug,
+		BaseURL:        cfg.BaseURL,
+		GeoIP:          geo,
+		EmailWebhooks:  webhooks,
+		UploadLimit:    cfg.UploadLimit,
+		StorageQuotas:  cfg.StorageQuotas,
+		Scanner:        scanner,
+		AllowUnscanned: cfg.ClamdAllowUnscanned,
+		RateLimiter:    limiter,
 	}
 	handler := controllers.Setup(config)
 	// Middleware
-	handler = middleware.NewRateLimiter(7, 14, 15*time.Minute).Limit(handler)
-	handler = middleware.Recover(handler)
+	handler = middleware.Recover(handler, cfg.Debug)
+	// Development runs over plain HTTP so no HSTS
+	handler = middleware.SecurityHeaders(handler, !cfg.Debug)
+	handler = middleware.Compress(handler)
+	handler = middleware.AccessLog(handler, middleware.AccessLogConfig{
+		SampleRate:    cfg.AccessLogSampleRate,
+		SlowThreshold: cfg.AccessLogSlow,
+	})
+	handler = middleware.Trace(handler)
+	handler = middleware.RequestID(handler)
 	// ---------------------------
 	server := &http.Server{
 		Addr:    ":" + strconv.Itoa(cfg.Port),
@@ -103,6 +317,24 @@ func main() {
 			os.Exit(1)
 		}
 	}()
+	// The admin server is kept off the public port, it should only be
+	// reachable from inside the network
+	var adminServer *http.Server
+	if cfg.MetricsToken != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("GET /metrics", middleware.BearerToken(metrics.Default, cfg.MetricsToken))
+		adminServer = &http.Server{
+			Addr:    ":" + strconv.Itoa(cfg.AdminPort),
+			Handler: adminMux,
+		}
+		go func() {
+			slog.Info("Admin.Serve", "httpAddr", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Failed to listen on admin port", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscanll.SIGTERM
 	// kill -2 is syscall.SIGINT
@@ -110,11 +342,21 @@ func main() {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	sig := <-quit
 	slog.Info("Shutting down server...", "signal", sig.String())
+	stopGC()
+	limiter.Stop()
 	// The default kubernetes grace period is 30 seconds
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	if err := server.Shutdown(ctx); err != nil {
 		slog.Error("Server forced to shutdown", "error", err)
 	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			slog.Error("Admin server forced to shutdown", "error", err)
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Could not flush traces", "error", err)
+	}
 	cancel()
 	slog.Info("Server stopped")
 }
@@ -0,0 +1,275 @@
+// Package metrics exposes counters, histograms and gauges in the Prometheus
+// text format without pulling in the Prometheus client and its dependencies.
+// Metrics are registered once, usually as package variables, and served by a
+// Registry's handler.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Only what we use is implemented: counters and histograms with labels, and
+ * gauges or counters read at scrape time for values kept elsewhere, e.g. the
+ * database pool. See
+ * https://prometheus.io/docs/instrumenting/exposition_formats/ for the format.
+ *
+ * Each labelled series is keyed by its label values joined with a separator
+ * that can't appear in valid UTF-8, series are created on first use and never
+ * removed so label values must come from a small fixed set, never from user
+ * input. */
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the application's metrics are registered with.
+var Default = NewRegistry()
+
+const labelSeparator = "\xff"
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics by name.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (reg *Registry) register(name string, m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	reg.metrics[name] = m
+}
+
+// ServeHTTP writes all metrics sorted by name.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	names := make([]string, 0, len(reg.metrics))
+	for name := range reg.metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = reg.metrics[name]
+	}
+	reg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// desc is the name, help and label names shared by every kind of metric.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.kind)
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+// sample writes one line, extra is an additional label such as le.
+func (d desc) sample(w *bufio.Writer, suffix, key string, extra []string, v float64) {
+	w.WriteString(d.name + suffix)
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, d.labels[i]+"="+quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quote(extra[i+1]))
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of series in a stable order.
+func sortedKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// ---------------------------
+
+// Counter only goes up, e.g. requests served.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]float64
+}
+
+// Counter registers a counter with the given label names. By convention the
+// name ends in _total.
+func (reg *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, series: make(map[string]float64)}
+	reg.register(name, c)
+	return c
+}
+
+// Inc adds one to the series with the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the label
+// values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.name + " cannot decrease")
+	}
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.series[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.series) {
+		c.sample(w, "", key, nil, c.series[key])
+	}
+}
+
+// ---------------------------
+
+// Histogram counts observations into buckets, e.g. request latencies.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets in
+// increasing order, DefaultBuckets if nil.
+func (reg *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	h := &Histogram{desc: desc{name, help, "histogram", labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	reg.register(name, h)
+	return h
+}
+
+// Observe records v in the series with the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	// Anything above the last bound only counts towards +Inf
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.sample(w, "_bucket", key, []string{"le", formatFloat(bound)}, float64(cumulative))
+		}
+		h.sample(w, "_bucket", key, []string{"le", "+Inf"}, float64(s.count))
+		h.sample(w, "_sum", key, nil, s.sum)
+		h.sample(w, "_count", key, nil, float64(s.count))
+	}
+}
+
+// ---------------------------
+
+// funcMetric reads its value when scraped.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+// GaugeFunc registers a gauge whose value is read from f on every scrape,
+// e.g. open connections.
+func (reg *Registry) GaugeFunc(name, help string, f func() float64) {
+	reg.register(name, &funcMetric{desc{name, help, "gauge", nil}, f})
+}
+
+// CounterFunc registers a counter kept elsewhere which is read from f on
+// every scrape.
+func (reg *Registry) CounterFunc(name, help string, f func() float64) {
+	reg.register(name, &funcMetric{desc{name, help, "counter", nil}, f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	m.sample(w, "", "", nil, m.f())
+}
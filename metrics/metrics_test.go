@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func scrape(t *testing.T, reg *Registry) string {
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.Counter("requests_total", "Requests served.", "route", "status")
+	latency := reg.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	reg.GaugeFunc("connections", "Open connections.", func() float64 { return 3 })
+	reg.CounterFunc("waits_total", "Waits for a connection.", func() float64 { return 7 })
+
+	requests.Inc("GET /", "200")
+	requests.Add(2, "GET /", "200")
+	requests.Inc(`say "hi"`+"\n\\", "500")
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	want := `# HELP connections Open connections.
+# TYPE connections gauge
+connections 3
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="GET /",status="200"} 3
+requests_total{route="say \"hi\"\n\\",status="500"} 1
+# HELP waits_total Waits for a connection.
+# TYPE waits_total counter
+waits_total 7
+`
+	require.Equal(t, want, scrape(t, reg))
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("c_total", "", "a")
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{"Duplicate", func() { reg.Counter("c_total", "") }},
+		{"LabelCount", func() { c.Inc("x", "y") }},
+		{"Decrease", func() { c.Add(-1, "x") }},
+		{"UnsortedBuckets", func() { reg.Histogram("h", "", []float64{1, 0.5}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Panics(t, tt.f)
+		})
+	}
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("c_total", "", "a")
+	h := reg.Histogram("h", "", nil, "a")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				c.Inc("x")
+				h.Observe(0.2, "x")
+			}
+		}()
+	}
+	// Scraping while recording must not race
+	scrape(t, reg)
+	wg.Wait()
+	body := scrape(t, reg)
+	require.True(t, strings.Contains(body, `c_total{a="x"} 800`), body)
+	require.True(t, strings.Contains(body, `h_bucket{a="x",le="0.25"} 800`), body)
+	require.True(t, strings.Contains(body, `h_bucket{a="x",le="0.1"} 0`), body)
+}
+
+func TestRegisterDBStats(t *testing.T) {
+	gdb, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	db, err := gdb.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(4)
+	require.NoError(t, db.Ping())
+	reg := NewRegistry()
+	RegisterDBStats(reg, db)
+	body := scrape(t, reg)
+	require.Contains(t, body, "db_max_open_connections 4\n")
+	require.Contains(t, body, "db_open_connections 1\n")
+	require.Contains(t, body, "# TYPE db_wait_count_total counter\n")
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"database/sql"
+)
+
+// RegisterDBStats registers the connection pool statistics of db, read on
+// every scrape.
+func RegisterDBStats(reg *Registry, db *sql.DB) {
+	reg.GaugeFunc("db_max_open_connections", "Maximum number of open connections to the database, 0 is unlimited.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	reg.GaugeFunc("db_open_connections", "Established connections both in use and idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	reg.GaugeFunc("db_in_use_connections", "Connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	reg.GaugeFunc("db_idle_connections", "Idle connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	reg.CounterFunc("db_wait_count_total", "Connections waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	reg.CounterFunc("db_wait_duration_seconds_total", "Time blocked waiting for a connection.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	reg.CounterFunc("db_max_idle_closed_total", "Connections closed due to the idle limit.", func() float64 {
+		return float64(db.Stats().MaxIdleClosed)
+	})
+	reg.CounterFunc("db_max_lifetime_closed_total", "Connections closed due to their maximum lifetime.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+}
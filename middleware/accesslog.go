@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* AccessLog writes one line per request once the response is complete.
+ * Details only known deeper in the handler chain, such as the logged in user
+ * or the matched route pattern, are added with AnnotateAccessLog because the
+ * request we hold is not the one the inner handlers see.
+ *
+ * Busy sites can log a sample of requests, server errors and slow requests
+ * are always logged so nothing worth looking at is dropped. */
+
+type AccessLogConfig struct {
+	// Fraction of ordinary requests to log, 0 logs all of them
+	SampleRate float64
+	// Requests taking longer are logged as warnings, 0 disables
+	SlowThreshold time.Duration
+}
+
+type accessLogKey struct{}
+
+// accessDetails collects attributes for the access log line of a request.
+type accessDetails struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// AnnotateAccessLog adds attributes to the access log line of the request
+// with the given context. It does nothing outside of AccessLog.
+func AnnotateAccessLog(ctx context.Context, attrs ...slog.Attr) {
+	d, ok := ctx.Value(accessLogKey{}).(*accessDetails)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	d.attrs = append(d.attrs, attrs...)
+	d.mu.Unlock()
+}
+
+// accessRecorder captures the status and size of the response.
+type accessRecorder struct {
+	passthrough
+	status   int
+	size     int64
+	hijacked bool
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	// Informational responses, e.g. 103 Early Hints, precede the real one
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps io.Copy able to use sendfile when serving files.
+func (w *accessRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.size += n
+	return n, err
+}
+
+func (w *accessRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.passthrough.Flush()
+}
+
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.passthrough.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// finalStatus is the status the client got, returned is false while a panic
+// is passing through.
+func (w *accessRecorder) finalStatus(returned bool) int {
+	switch {
+	case w.status != 0 || w.hijacked:
+		return w.status
+	case !returned:
+		// The server will abort the response
+		return http.StatusInternalServerError
+	default:
+		// Nothing written, net/http sends an empty 200
+		return http.StatusOK
+	}
+}
+
+func AccessLog(next http.Handler, cfg AccessLogConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		details := &accessDetails{}
+		rec := &accessRecorder{passthrough: passthrough{w}}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, details))
+		returned := false
+		defer func() {
+			duration := time.Since(start)
+			status := rec.finalStatus(returned)
+			level := slog.LevelInfo
+			switch {
+			case status >= 500:
+				level = slog.LevelError
+			case cfg.SlowThreshold > 0 && duration >= cfg.SlowThreshold:
+				level = slog.LevelWarn
+			case cfg.SampleRate > 0 && cfg.SampleRate < 1 && rand.Float64() >= cfg.SampleRate:
+				return
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("uri", r.RequestURI),
+				slog.Int("status", status),
+				slog.Int64("size", rec.size),
+				slog.Duration("duration", duration),
+				slog.String("remote_ip", ClientIP(r)),
+			}
+			if rec.hijacked {
+				attrs = append(attrs, slog.Bool("hijacked", true))
+			}
+			details.mu.Lock()
+			attrs = append(attrs, details.attrs...)
+			details.mu.Unlock()
+			slog.LogAttrs(r.Context(), level, "Request completed", attrs...)
+		}()
+		next.ServeHTTP(rec, r)
+		returned = true
+	})
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs collects the records logged during the test as JSON objects.
+func captureLogs(t *testing.T) func() []map[string]any {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return func() []map[string]any {
+		var records []map[string]any
+		dec := json.NewDecoder(&buf)
+		for {
+			var rec map[string]any
+			if err := dec.Decode(&rec); err != nil {
+				return records
+			}
+			records = append(records, rec)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AccessLogConfig
+		handler http.HandlerFunc
+		want    map[string]any
+	}{
+		{"Written", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "hello")
+		}, map[string]any{"status": 201.0, "size": 5.0, "level": "INFO"}},
+		{"ImplicitOK", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hi")
+		}, map[string]any{"status": 200.0, "size": 2.0}},
+		{"NothingWritten", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {}, map[string]any{"status": 200.0, "size": 0.0}},
+		{"EarlyHints", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusAccepted)
+		}, map[string]any{"status": 202.0}},
+		{"Copied", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, strings.NewReader("copied"))
+		}, map[string]any{"status": 200.0, "size": 6.0}},
+		{"Annotated", AccessLogConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			AnnotateAccessLog(r.Context(), slog.String("route", "GET /x"), slog.Int("userId", 7))
+		}, map[string]any{"route": "GET /x", "userId": 7.0}},
+		{"ServerError", AccessLogConfig{SampleRate: 0.000001}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}, map[string]any{"status": 502.0, "level": "ERROR"}},
+		{"Slow", AccessLogConfig{SampleRate: 0.000001, SlowThreshold: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(2 * time.Millisecond)
+		}, map[string]any{"level": "WARN"}},
+		{"Sampled", AccessLogConfig{SampleRate: 0.000001}, func(w http.ResponseWriter, r *http.Request) {}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			w := httptest.NewRecorder()
+			AccessLog(tt.handler, tt.cfg).ServeHTTP(w, httptest.NewRequest("GET", "/path?q=1", nil))
+			records := logs()
+			if tt.want == nil {
+				require.Empty(t, records)
+				return
+			}
+			require.Len(t, records, 1)
+			require.Equal(t, "Request completed", records[0]["msg"])
+			require.Equal(t, "/path?q=1", records[0]["uri"])
+			for k, v := range tt.want {
+				require.Equal(t, v, records[0][k], k)
+			}
+		})
+	}
+}
+
+func TestAccessLog_Panic(t *testing.T) {
+	logs := captureLogs(t)
+	h := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), AccessLogConfig{})
+	require.Panics(t, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+	records := logs()
+	require.Len(t, records, 1)
+	require.Equal(t, 500.0, records[0]["status"])
+}
+
+func TestAccessLog_Flusher(t *testing.T) {
+	captureLogs(t)
+	for name, wrap := range map[string]func(http.Handler) http.Handler{
+		"AccessLog":         func(h http.Handler) http.Handler { return AccessLog(h, AccessLogConfig{}) },
+		"ErrorPageRenderer": ErrorPageRenderer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, ok := w.(http.Flusher)
+				require.True(t, ok)
+				io.WriteString(w, "part")
+				f.Flush()
+			}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			require.True(t, w.Flushed)
+		})
+	}
+}
+
+func TestAccessLog_Hijacker(t *testing.T) {
+	logs := captureLogs(t)
+	srv := httptest.NewServer(AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	}), AccessLogConfig{}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "hijacked", string(body))
+	srv.Close()
+	records := logs()
+	require.Len(t, records, 1)
+	require.Equal(t, true, records[0]["hijacked"])
+
+	// Recorders can't be hijacked, which is reported rather than hidden
+	AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		require.ErrorIs(t, err, http.ErrNotSupported)
+	}), AccessLogConfig{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
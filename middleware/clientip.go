@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/* Proxies in front of the application, e.g. a load balancer, report who they
+ * forward for in the Forwarded (RFC 7239) or X-Forwarded-For headers. Every
+ * proxy appends the address it received the request from, so the header is
+ * only as trustworthy as the proxy that added each entry: a client can put
+ * anything at the start. We therefore walk the chain from the right, starting
+ * with the connection itself, and stop at the first address that is not one
+ * of our trusted proxies. That is the client. Without trusted proxies the
+ * headers are ignored and the connection address is used. */
+
+var trustedProxies []netip.Prefix
+
+// SetTrustedProxies sets the proxies whose forwarding headers we believe, as
+// CIDRs or single addresses e.g. "10.0.0.0/8" or "192.0.2.1". It should be
+// called once on startup before serving requests.
+func SetTrustedProxies(proxies []string) error {
+	var prefixes []netip.Prefix
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+func trusted(addr netip.Addr) bool {
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client, looking past trusted proxies.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+	if !trusted(addr) {
+		return addr.String()
+	}
+	// Forwarded supersedes X-Forwarded-For when a proxy sends both
+	var hops []string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = forwardedFor(fwd)
+	} else {
+		for _, xff := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(xff, ",")...)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			// Obfuscated or unknown, the trusted proxy that reported it is
+			// the best we know
+			break
+		}
+		addr = hop
+		if !trusted(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// forwardedFor returns the for parameter of every element in Forwarded
+// headers, empty for elements without one.
+func forwardedFor(headers []string) []string {
+	var hops []string
+	for _, h := range headers {
+		for _, element := range splitQuoted(h, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					hop = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses an address as found in X-Forwarded-For or a Forwarded for
+// parameter, e.g. 192.0.2.1, "192.0.2.1:4711" or "[2001:db8::1]:4711".
+// Obfuscated identifiers and "unknown" are not addresses.
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
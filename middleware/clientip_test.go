@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	require.NoError(t, SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8:cafe::/48"}))
+	t.Cleanup(func() { trustedProxies = nil })
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{"Direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"DirectIgnoresHeaders", "203.0.113.7:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}, "Forwarded": {"for=1.1.1.1"}}, "203.0.113.7"},
+		{"MappedIPv4", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+		{"InvalidRemote", "nonsense", nil, "unknown"},
+		{"TrustedWithoutHeaders", "10.0.0.1:80", nil, "10.0.0.1"},
+		{"XFF", "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		// The client made up the first entry, our proxy appended the real one
+		{"XFFSpoofed", "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7"}}, "203.0.113.7"},
+		{"XFFChain", "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7, 10.1.1.1", "192.0.2.1"}}, "203.0.113.7"},
+		{"XFFAllTrusted", "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"10.2.2.2, 10.1.1.1"}}, "10.2.2.2"},
+		{"XFFGarbage", "10.0.0.1:80", map[string][]string{"X-Forwarded-For": {"203.0.113.7, garbage"}}, "10.0.0.1"},
+		{"Forwarded", "10.0.0.1:80", map[string][]string{"Forwarded": {"for=203.0.113.7;proto=https;by=10.0.0.1"}}, "203.0.113.7"},
+		{"ForwardedChain", "10.0.0.1:80", map[string][]string{"Forwarded": {`for=1.2.3.4, for="203.0.113.7:4711"`, "For=10.3.3.3"}}, "203.0.113.7"},
+		{"ForwardedIPv6", "[2001:db8:cafe::1]:80", map[string][]string{"Forwarded": {`for="[2001:db8:beef::17]:4711"`}}, "2001:db8:beef::17"},
+		{"ForwardedQuotedSeparator", "10.0.0.1:80", map[string][]string{"Forwarded": {`for=203.0.113.7;host="a,b;c"`}}, "203.0.113.7"},
+		{"ForwardedObfuscated", "10.0.0.1:80", map[string][]string{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+		{"ForwardedUnknown", "10.0.0.1:80", map[string][]string{"Forwarded": {"for=203.0.113.7, for=unknown"}}, "10.0.0.1"},
+		{"ForwardedWithoutFor", "10.0.0.1:80", map[string][]string{"Forwarded": {"proto=https"}}, "10.0.0.1"},
+		{"ForwardedPreferred", "10.0.0.1:80", map[string][]string{"Forwarded": {"for=203.0.113.7"}, "X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			require.Equal(t, tt.want, ClientIP(r))
+		})
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { trustedProxies = nil })
+	require.NoError(t, SetTrustedProxies([]string{" 10.0.0.0/8 ", "", "::1", "172.16.5.4/12"}))
+	require.Len(t, trustedProxies, 3)
+	require.Equal(t, "172.16.0.0/12", trustedProxies[2].String())
+	require.Error(t, SetTrustedProxies([]string{"10.0.0.0/33"}))
+	require.Error(t, SetTrustedProxies([]string{"proxy.example.com"}))
+	// Nothing is trusted without proxies
+	require.NoError(t, SetTrustedProxies(nil))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:80"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	require.Equal(t, "127.0.0.1", ClientIP(r))
+}
@@ -1,27 +1,12 @@
 package middleware
 
 import (
-	"log/slog"
 	"net/http"
-	"runtime/debug"
 
 	"github.com/nuric/go-web-app-template/utils"
 )
 
 // ---------------------------
-func Recover(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				slog.Error("panic recovered", "error", err)
-				slog.Error("stack trace", "stack", string(debug.Stack()))
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
-}
-
 func APIKey(next http.Handler, key string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		apiKey := r.Header.Get("X-API-Key")
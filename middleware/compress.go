@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+/* Compress encodes responses with brotli or gzip depending on what the client
+ * accepts. Only textual responses are compressed, images, archives and the
+ * like are compressed already and would only cost CPU. Responses that carry a
+ * Content-Encoding, e.g. precompressed static files, are left alone.
+ *
+ * Whether to compress is decided when the handler starts the body because
+ * that's when the Content-Type is known, so WriteHeader is held back until
+ * then. */
+
+// Ordered by preference when the client accepts several equally
+var encodings = []string{"br", "gzip"}
+
+// Small responses don't shrink enough to be worth it
+const compressMinSize = 512
+
+var gzipPool = sync.Pool{New: func() any {
+	return gzip.NewWriter(io.Discard)
+}}
+
+var brotliPool = sync.Pool{New: func() any {
+	// Level 4 compresses about as well as gzip's default but faster
+	return brotli.NewWriterLevel(io.Discard, 4)
+}}
+
+// negotiateEncoding picks the encoding to use from Accept-Encoding, empty if
+// the client accepts none of the offered ones.
+func negotiateEncoding(r *http.Request, offered []string) string {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		q, ok := quality[enc]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+func varyAcceptEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter decides on the first write whether to encode the body.
+type compressWriter struct {
+	passthrough
+	r        *http.Request
+	encoding string
+	status   int
+	decided  bool
+	enc      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || code < 200 {
+		// Informational responses go out as they are
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// decide starts the response, with an encoder if the body is worth
+// compressing.
+func (w *compressWriter) decide(first []byte) {
+	w.decided = true
+	h := w.Header()
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if h.Get("Content-Type") == "" && len(first) > 0 {
+		// What net/http would set anyway, we need it to decide
+		h.Set("Content-Type", http.DetectContentType(first))
+	}
+	size, err := strconv.Atoi(h.Get("Content-Length"))
+	small := err == nil && size < compressMinSize
+	// Partial content ranges refer to the uncompressed body
+	if status == http.StatusPartialContent || status == http.StatusNoContent || status == http.StatusNotModified ||
+		w.r.Method == http.MethodHead || small || h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The encoded body is no longer byte for byte the tagged one
+		h.Set("ETag", "W/"+etag)
+	}
+	switch w.encoding {
+	case "br":
+		bw := brotliPool.Get().(*brotli.Writer)
+		bw.Reset(w.ResponseWriter)
+		w.enc = bw
+	case "gzip":
+		gw := gzipPool.Get().(*gzip.Writer)
+		gw.Reset(w.ResponseWriter)
+		w.enc = gw
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decide(b)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.enc.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(nil)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	w.passthrough.Flush()
+}
+
+// finish completes the encoded body and returns the encoder to its pool.
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decide(nil)
+	}
+	if w.enc == nil {
+		return
+	}
+	_ = w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *brotli.Writer:
+		enc.Reset(io.Discard)
+		brotliPool.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipPool.Put(enc)
+	}
+	w.enc = nil
+}
+
+// Compress encodes textual responses with brotli or gzip.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Caches must not hand a compressed response to a client that can't
+		// decode it, whether or not this one is compressed
+		varyAcceptEncoding(w.Header())
+		encoding := negotiateEncoding(r, encodings)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{passthrough: passthrough{w}, r: r, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		// Not deferred, closing the encoder after a panic would end a
+		// truncated body as if it were complete
+		cw.finish()
+	})
+}
+
+// PrecompressedFileServer serves files like http.FileServerFS but prefers a
+// .br or .gz variant of the requested file if the client accepts it, so
+// static assets are compressed once at build time rather than per request.
+func PrecompressedFileServer(fsys fs.FS) http.Handler {
+	files := http.FileServerFS(fsys)
+	suffixes := map[string]string{"br": ".br", "gzip": ".gz"}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyAcceptEncoding(w.Header())
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		var offered []string
+		for _, enc := range encodings {
+			if _, err := fs.Stat(fsys, name+suffixes[enc]); err == nil {
+				offered = append(offered, enc)
+			}
+		}
+		encoding := negotiateEncoding(r, offered)
+		if encoding == "" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		f, err := fsys.Open(name + suffixes[encoding])
+		if err != nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		rs, ok := f.(io.ReadSeeker)
+		if err != nil || !ok {
+			files.ServeHTTP(w, r)
+			return
+		}
+		// The type is that of the original, not of the compressed variant
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		http.ServeContent(w, r, name, info.ModTime(), rs)
+	})
+}
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	var r io.Reader
+	switch encoding {
+	case "br":
+		r = brotli.NewReader(body)
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		require.NoError(t, err)
+		r = gr
+	default:
+		r = body
+	}
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip", "gzip"},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			require.Equal(t, tt.want, negotiateEncoding(r, encodings))
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>Hello, world</p>\n", 100)
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		status      int
+		body        string
+		encoded     bool
+	}{
+		{"Brotli", "gzip, br", "text/html; charset=utf-8", http.StatusOK, page, true},
+		{"Gzip", "gzip", "application/json", http.StatusOK, `{"a":"` + page + `"}`, true},
+		{"Sniffed", "gzip", "", http.StatusOK, "<!DOCTYPE html>" + page, true},
+		{"ErrorStatus", "gzip", "text/html", http.StatusNotFound, page, true},
+		{"NotAccepted", "", "text/html", http.StatusOK, page, false},
+		{"Image", "gzip", "image/png", http.StatusOK, page, false},
+		{"Small", "gzip", "text/plain", http.StatusOK, "short", false},
+		{"PartialContent", "gzip", "text/plain", http.StatusPartialContent, page, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if len(tt.body) < compressMinSize {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				w.WriteHeader(tt.status)
+				// Several writes to check the stream spans them
+				half := len(tt.body) / 2
+				_, _ = io.WriteString(w, tt.body[:half])
+				_, _ = io.WriteString(w, tt.body[half:])
+			}))
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, []string{"Accept-Encoding"}, w.Header().Values("Vary"))
+			encoding := w.Header().Get("Content-Encoding")
+			if tt.encoded {
+				require.Equal(t, negotiateEncoding(r, encodings), encoding)
+				require.Empty(t, w.Header().Get("Content-Length"))
+				require.Less(t, w.Body.Len(), len(tt.body))
+			} else {
+				require.Empty(t, encoding)
+			}
+			require.Equal(t, tt.body, decode(t, encoding, w.Body))
+		})
+	}
+}
+
+func TestCompress_AlreadyEncoded(t *testing.T) {
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = io.WriteString(w, strings.Repeat("x", 2*compressMinSize))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	require.Equal(t, strings.Repeat("x", 2*compressMinSize), w.Body.String())
+}
+
+func TestCompress_Flush(t *testing.T) {
+	first := "data: first\n\n"
+	w := httptest.NewRecorder()
+	h := Compress(http.HandlerFunc(func(cw http.ResponseWriter, r *http.Request) {
+		cw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(cw, first)
+		require.NoError(t, http.NewResponseController(cw).Flush())
+		// What was flushed must decode before the response ends
+		gr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		require.NoError(t, err)
+		got := make([]byte, len(first))
+		_, err = io.ReadFull(gr, got)
+		require.NoError(t, err)
+		require.Equal(t, first, string(got))
+		_, _ = io.WriteString(cw, "data: second\n\n")
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	require.True(t, w.Flushed)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(t, first+"data: second\n\n", decode(t, "gzip", w.Body))
+}
+
+func TestPrecompressedFileServer(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 50)
+	fsys := fstest.MapFS{
+		"main.css":    {Data: []byte(css)},
+		"main.css.br": {Data: []byte("brotli bytes")},
+		"main.css.gz": {Data: []byte("gzip bytes")},
+		"other.css":   {Data: []byte(css)},
+	}
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		encoding string
+		body     string
+	}{
+		{"Brotli", "/main.css", "gzip, br", "br", "brotli bytes"},
+		{"Gzip", "/main.css", "gzip", "gzip", "gzip bytes"},
+		{"Identity", "/main.css", "", "", css},
+		{"NoVariant", "/other.css", "gzip, br", "", css},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			PrecompressedFileServer(fsys).ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.encoding, w.Header().Get("Content-Encoding"))
+			require.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+			require.Equal(t, []string{"Accept-Encoding"}, w.Header().Values("Vary"))
+			require.Equal(t, tt.body, w.Body.String())
+		})
+	}
+}
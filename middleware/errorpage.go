@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/nuric/go-web-app-template/templates"
+	"github.com/nuric/go-web-app-template/utils"
+)
+
+/* Handlers report errors with a status code and usually a short plain text
+ * message from http.Error. ErrorPageRenderer intercepts the status codes we
+ * have a page for and replaces the response: browsers get the page and API
+ * clients, anything not asking for HTML, get a JSON error carrying the
+ * message. Responses that are already HTML or JSON were rendered on purpose
+ * and are left alone.
+ *
+ * Nothing is sent until the handler returns, so a panic halfway through still
+ * leaves Recover a clean response to write the 500 page to. */
+
+// errorPages maps status codes to their templates.
+var errorPages = map[int]string{
+	http.StatusForbidden:           "403.html",
+	http.StatusNotFound:            "404.html",
+	http.StatusTooManyRequests:     "429.html",
+	http.StatusInternalServerError: "500.html",
+}
+
+// How much of the handler's message we keep for the JSON error
+const maxErrorMessage = 1024
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// writeError sends the error page or JSON error for status. The stack is only
+// shown on the 500 page.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string, stack string) {
+	h := w.Header()
+	// Whatever the handler set described a different body
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	page, ok := errorPages[status]
+	if !ok || !wantsHTML(r) {
+		utils.Encode(w, status, map[string]string{"error": message})
+		return
+	}
+	data := map[string]any{
+		"Title":   http.StatusText(status),
+		"Status":  status,
+		"Message": message,
+		"Stack":   stack,
+		// Error pages use the same layouts as every other page
+		"CSPNonce": CSPNonce(r),
+	}
+	if retryAfter, err := time.ParseDuration(h.Get("Retry-After") + "s"); err == nil {
+		data["RetryAfter"] = retryAfter
+	}
+	var buf bytes.Buffer
+	if err := templates.Render(&buf, page, data); err != nil {
+		slog.ErrorContext(r.Context(), "could not render error page", "error", err, "status", status)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+type errorPageInterceptor struct {
+	passthrough
+	r       *http.Request
+	wrote   bool
+	status  int // Intercepted status, 0 while passing through
+	message bytes.Buffer
+}
+
+func (e *errorPageInterceptor) WriteHeader(code int) {
+	if e.wrote || code < 200 {
+		e.ResponseWriter.WriteHeader(code)
+		return
+	}
+	e.wrote = true
+	contentType := e.Header().Get("Content-Type")
+	_, ok := errorPages[code]
+	if !ok || strings.HasPrefix(contentType, "text/html") || strings.HasPrefix(contentType, "application/json") {
+		e.ResponseWriter.WriteHeader(code)
+		return
+	}
+	e.status = code
+}
+
+func (e *errorPageInterceptor) Write(b []byte) (int, error) {
+	// An implicit 200 is never intercepted
+	e.wrote = true
+	if e.status == 0 {
+		return e.ResponseWriter.Write(b)
+	}
+	// Pretend we wrote it so handlers don't treat it as an error
+	if room := maxErrorMessage - e.message.Len(); room > 0 {
+		e.message.Write(b[:min(len(b), room)])
+	}
+	return len(b), nil
+}
+
+func (e *errorPageInterceptor) Flush() {
+	if e.status == 0 {
+		e.passthrough.Flush()
+	}
+}
+
+// finish writes the error page in place of the intercepted response.
+func (e *errorPageInterceptor) finish() {
+	if e.status == 0 {
+		return
+	}
+	var message string
+	if strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		message = strings.TrimSpace(e.message.String())
+	}
+	writeError(e.ResponseWriter, e.r, e.status, message, "")
+}
+
+func ErrorPageRenderer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		interceptor := &errorPageInterceptor{passthrough: passthrough{w}, r: r}
+		next.ServeHTTP(interceptor, r)
+		interceptor.finish()
+	})
+}
+
+// headerTracker notes whether the response has started.
+type headerTracker struct {
+	passthrough
+	wrote bool
+}
+
+func (t *headerTracker) WriteHeader(code int) {
+	if code >= 200 {
+		t.wrote = true
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *headerTracker) Write(b []byte) (int, error) {
+	t.wrote = true
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *headerTracker) Flush() {
+	t.wrote = true
+	t.passthrough.Flush()
+}
+
+func (t *headerTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	t.wrote = true
+	return t.passthrough.Hijack()
+}
+
+// Recover turns panics into the 500 page, with the stack on it if showStack
+// is set which should only be the case during development.
+func Recover(next http.Handler, showStack bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker := &headerTracker{passthrough: passthrough{w}}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			stack := string(debug.Stack())
+			slog.ErrorContext(r.Context(), "panic recovered", "error", err)
+			slog.ErrorContext(r.Context(), "stack trace", "stack", stack)
+			if tracker.wrote {
+				// Too late for a page, abort so the client sees the response
+				// is incomplete instead of taking it as whole
+				panic(http.ErrAbortHandler)
+			}
+			if !showStack {
+				stack = ""
+			}
+			writeError(w, r, http.StatusInternalServerError, "", stack)
+		}()
+		next.ServeHTTP(tracker, r)
+	})
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorPageRenderer(t *testing.T) {
+	html := http.Header{"Accept": {"text/html,application/xhtml+xml"}}
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		header      http.Header
+		status      int
+		contentType string
+		body        string
+	}{
+		{"NotFoundPage", http.NotFound, html, http.StatusNotFound, "text/html; charset=utf-8", "404 - Page Not Found"},
+		{"NotFoundJSON", http.NotFound, nil, http.StatusNotFound, "application/json", `{"error":"404 page not found"}`},
+		{"ForbiddenPage", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "This link has expired", http.StatusForbidden)
+		}, html, http.StatusForbidden, "text/html; charset=utf-8", "This link has expired"},
+		{"ServerErrorPage", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "could not open file", http.StatusInternalServerError)
+		}, html, http.StatusInternalServerError, "text/html; charset=utf-8", "500 - Internal Server Error"},
+		{"ServerErrorJSON", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "could not open file", http.StatusInternalServerError)
+		}, nil, http.StatusInternalServerError, "application/json", `{"error":"could not open file"}`},
+		{"TooManyRequests", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "90")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}, html, http.StatusTooManyRequests, "text/html; charset=utf-8", "Please wait 1m30s"},
+		{"StatusOnlyJSON", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}, nil, http.StatusForbidden, "application/json", `{"error":"Forbidden"}`},
+		{"UnmappedStatus", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Upload expired", http.StatusGone)
+		}, html, http.StatusGone, "text/plain; charset=utf-8", "Upload expired"},
+		{"OwnJSON", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"error":"forbidden"}`)
+		}, html, http.StatusForbidden, "application/json", `{"error":"forbidden"}`},
+		{"OK", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "fine")
+		}, html, http.StatusOK, "text/plain; charset=utf-8", "fine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != nil {
+				r.Header = tt.header
+			}
+			w := httptest.NewRecorder()
+			ErrorPageRenderer(tt.handler).ServeHTTP(w, r)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			require.Contains(t, w.Body.String(), tt.body)
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	html := http.Header{"Accept": {"text/html"}}
+	tests := []struct {
+		name      string
+		showStack bool
+		header    http.Header
+		body      string
+		notBody   string
+	}{
+		{"Page", false, html, "500 - Internal Server Error", "runtime/debug"},
+		{"PageWithStack", true, html, "runtime/debug", ""},
+		{"JSON", true, nil, `{"error":"Internal Server Error"}`, "runtime/debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An intercepted error has not been sent yet so the page replaces it
+			h := Recover(ErrorPageRenderer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				panic("boom")
+			})), tt.showStack)
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != nil {
+				r.Header = tt.header
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, http.StatusInternalServerError, w.Code)
+			require.Contains(t, w.Body.String(), tt.body)
+			if tt.notBody != "" {
+				require.NotContains(t, w.Body.String(), tt.notBody)
+			}
+		})
+	}
+}
+
+func TestRecover_Abort(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"AfterWrite", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "partial")
+			panic("boom")
+		}},
+		{"Abort", func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+				Recover(tt.handler, true).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			})
+			require.NotContains(t, w.Body.String(), "Internal Server Error")
+		})
+	}
+}
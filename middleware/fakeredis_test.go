@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-process server speaking enough RESP for
+// RedisLimiterStore: hashes, expiry and optimistic transactions.
+type fakeRedis struct {
+	password string
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	versions map[string]int
+	ttls     map[string]time.Duration
+}
+
+func newFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	f := &fakeRedis{password: password, hashes: map[string]map[string]string{}, versions: map[string]int{}, ttls: map[string]time.Duration{}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ttls[key]
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	watched := map[string]int{}
+	var queued [][]string
+	multi := false
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		cmd := strings.ToUpper(args[0])
+		var out string
+		switch {
+		case cmd == "AUTH":
+			authed = len(args) == 2 && args[1] == f.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		case cmd == "MULTI":
+			multi, queued = true, nil
+			out = "+OK\r\n"
+		case cmd == "EXEC":
+			f.mu.Lock()
+			changed := false
+			for key, v := range watched {
+				changed = changed || f.versions[key] != v
+			}
+			if changed {
+				out = "*-1\r\n"
+			} else {
+				out = fmt.Sprintf("*%d\r\n", len(queued))
+				for _, q := range queued {
+					out += f.run(q)
+				}
+			}
+			f.mu.Unlock()
+			multi, watched = false, map[string]int{}
+		case multi:
+			queued = append(queued, args)
+			out = "+QUEUED\r\n"
+		case cmd == "WATCH":
+			f.mu.Lock()
+			for _, key := range args[1:] {
+				watched[key] = f.versions[key]
+			}
+			f.mu.Unlock()
+			out = "+OK\r\n"
+		case cmd == "UNWATCH":
+			watched = map[string]int{}
+			out = "+OK\r\n"
+		default:
+			f.mu.Lock()
+			out = f.run(args)
+			f.mu.Unlock()
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+// run executes a data command with the lock held and returns the reply.
+func (f *fakeRedis) run(args []string) string {
+	bulk := func(s string, ok bool) string {
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "HMGET":
+		out := fmt.Sprintf("*%d\r\n", len(args)-2)
+		for _, field := range args[2:] {
+			v, ok := f.hashes[args[1]][field]
+			out += bulk(v, ok)
+		}
+		return out
+	case "HSET":
+		h := f.hashes[args[1]]
+		if h == nil {
+			h = map[string]string{}
+			f.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		f.versions[args[1]]++
+		return ":1\r\n"
+	case "PEXPIRE":
+		ms, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		f.ttls[args[1]] = time.Duration(ms) * time.Millisecond
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
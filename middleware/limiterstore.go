@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+/* A LimiterStore keeps the token buckets of a RateLimiter. The in memory store
+ * is fine for a single instance, but with several replicas each would allow
+ * the full limit, so they should share a SQL or Redis store instead.
+ *
+ * Stores only persist how many tokens a bucket held when it was last used,
+ * the tokens that have refilled since are worked out on the next request. A
+ * bucket not used for a whole window is full again, so stores may forget it.
+ *
+ * Shared stores update buckets optimistically and retry through retryTake
+ * when another request got there first. If a bucket keeps changing under us
+ * someone is hammering it, which is what we are here to stop, so the request
+ * is rejected. Store errors on the other hand let requests through, see
+ * RateLimiter.Limit, so contention must not be reported as one. */
+
+// Times a shared store tries to update a bucket before rejecting the request
+const limiterAttempts = 5
+
+// retryTake calls attempt until it reports done or fails, waiting a random
+// and growing backoff between attempts so competing requests spread out. It
+// rejects the request once every attempt lost to another request.
+func retryTake(ctx context.Context, attempt func() (done, allowed bool, tokens float64, err error)) (bool, float64, error) {
+	for i := range limiterAttempts {
+		if i > 0 {
+			backoff := time.NewTimer(rand.N(time.Millisecond << i))
+			select {
+			case <-ctx.Done():
+				backoff.Stop()
+				return false, 0, ctx.Err()
+			case <-backoff.C:
+			}
+		}
+		done, allowed, tokens, err := attempt()
+		if err != nil {
+			return false, 0, err
+		}
+		if done {
+			return allowed, tokens, nil
+		}
+	}
+	return false, 0, nil
+}
+
+type LimiterStore interface {
+	// Take removes a token from the bucket of key if it has one. It returns
+	// whether it did and the tokens left.
+	Take(ctx context.Context, key string, p Policy, now time.Time) (allowed bool, tokens float64, err error)
+	// Cleanup forgets buckets last used before the given time.
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// refill returns the tokens in a bucket at now that held tokens at last.
+func refill(tokens float64, last, now time.Time, p Policy) float64 {
+	elapsed := now.Sub(last).Seconds()
+	if elapsed <= 0 {
+		return tokens
+	}
+	return math.Min(float64(p.Requests), tokens+elapsed*p.perSecond())
+}
+
+// take takes a token from a bucket that held tokens at last, or a new one if
+// it is the first request.
+func take(tokens float64, last, now time.Time, p Policy, exists bool) (bool, float64) {
+	if exists {
+		tokens = refill(tokens, last, now, p)
+	} else {
+		tokens = float64(p.Requests)
+	}
+	if tokens < 1 {
+		return false, tokens
+	}
+	return true, tokens - 1
+}
+
+type memoryBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// MemoryLimiterStore keeps buckets in process memory, the zero value is ready
+// to use.
+type MemoryLimiterStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func (m *MemoryLimiterStore) Take(ctx context.Context, key string, p Policy, now time.Time) (bool, float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets == nil {
+		m.buckets = make(map[string]*memoryBucket)
+	}
+	b, exists := m.buckets[key]
+	if !exists {
+		b = &memoryBucket{}
+		m.buckets[key] = b
+	}
+	allowed, tokens := take(b.tokens, b.lastSeen, now, p, exists)
+	b.tokens, b.lastSeen = tokens, now
+	return allowed, tokens, nil
+}
+
+func (m *MemoryLimiterStore) Cleanup(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, b := range m.buckets {
+		if b.lastSeen.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
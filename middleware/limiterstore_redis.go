@@ -0,0 +1,276 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* RedisLimiterStore keeps buckets in Redis, or anything speaking its protocol
+ * such as Valkey or KeyDB, as hashes holding the tokens and when they were
+ * last refilled. We talk RESP ourselves rather than pull in a client library,
+ * we only need a handful of commands:
+ * https://redis.io/docs/latest/develop/reference/protocol-spec/
+ *
+ * Concurrent requests are handled with an optimistic transaction: we WATCH
+ * the bucket, read it and only write it back if nobody else did in between,
+ * otherwise EXEC returns nil and we try again. Buckets expire once they would
+ * have refilled so Redis forgets them for us. */
+
+type RedisLimiterStore struct {
+	// host:port of the server
+	Addr     string
+	Password string
+	// Prefixed to every key, defaults to "ratelimit:"
+	Prefix string
+	// For each command round trip, defaults to a second
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle []*respConn
+}
+
+// Idle connections kept for reuse
+const redisMaxIdle = 8
+
+func (s *RedisLimiterStore) Take(ctx context.Context, key string, p Policy, now time.Time) (bool, float64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	allowed, tokens, err := s.take(ctx, conn, key, p, now)
+	if err != nil {
+		// The connection may be halfway through a reply
+		conn.Close()
+		return false, 0, err
+	}
+	s.release(conn)
+	return allowed, tokens, nil
+}
+
+func (s *RedisLimiterStore) take(ctx context.Context, conn *respConn, key string, p Policy, now time.Time) (bool, float64, error) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	key = prefix + key
+	return retryTake(ctx, func() (bool, bool, float64, error) {
+		if _, err := conn.do("WATCH", key); err != nil {
+			return false, false, 0, err
+		}
+		reply, err := conn.do("HMGET", key, "tokens", "last")
+		if err != nil {
+			return false, false, 0, err
+		}
+		fields, ok := reply.([]any)
+		if !ok || len(fields) != 2 {
+			return false, false, 0, fmt.Errorf("redis: unexpected HMGET reply %v", reply)
+		}
+		stored, exists := fields[0].(string)
+		var tokens float64
+		var last time.Time
+		if exists {
+			tokens, err = strconv.ParseFloat(stored, 64)
+			if err != nil {
+				return false, false, 0, fmt.Errorf("redis: invalid tokens %q", stored)
+			}
+			nanos, _ := fields[1].(string)
+			n, err := strconv.ParseInt(nanos, 10, 64)
+			if err != nil {
+				return false, false, 0, fmt.Errorf("redis: invalid timestamp %q", nanos)
+			}
+			last = time.Unix(0, n)
+		}
+		allowed, tokens := take(tokens, last, now, p, exists)
+		if !allowed {
+			if _, err := conn.do("UNWATCH"); err != nil {
+				return false, false, 0, err
+			}
+			return true, false, tokens, nil
+		}
+		ttl := strconv.FormatInt(p.Window.Milliseconds()+1, 10)
+		replies, err := conn.pipeline(
+			[]string{"MULTI"},
+			[]string{"HSET", key, "tokens", strconv.FormatFloat(tokens, 'f', -1, 64), "last", strconv.FormatInt(now.UnixNano(), 10)},
+			[]string{"PEXPIRE", key, ttl},
+			[]string{"EXEC"},
+		)
+		if err != nil {
+			return false, false, 0, err
+		}
+		// EXEC replies nil when the bucket changed since WATCH
+		return replies[3] != nil, true, tokens, nil
+	})
+}
+
+// Cleanup does nothing, buckets expire on their own.
+func (s *RedisLimiterStore) Cleanup(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// Close closes the idle connections.
+func (s *RedisLimiterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.idle {
+		c.Close()
+	}
+	s.idle = nil
+	return nil
+}
+
+func (s *RedisLimiterStore) conn(ctx context.Context) (*respConn, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		c.timeout = timeout
+		return c, nil
+	}
+	s.mu.Unlock()
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+	c := &respConn{Conn: nc, r: bufio.NewReader(nc), timeout: timeout}
+	if s.Password != "" {
+		if _, err := c.do("AUTH", s.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisLimiterStore) release(c *respConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= redisMaxIdle {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+// respConn sends commands as arrays of bulk strings and reads the replies.
+type respConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *respConn) do(args ...string) (any, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends all commands at once then reads a reply for each. Error
+// replies are returned as the error.
+func (c *respConn) pipeline(cmds ...[]string) ([]any, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := readRESP(c.r)
+		var re redisError
+		if errors.As(err, &re) {
+			// Keep reading so the connection stays in step
+			replyErr = errors.Join(replyErr, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// readRESP reads one reply: a string, int64, nil or []any for arrays.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = readRESP(r)
+			// e.g. a failed command inside EXEC, the rest still follows
+			var re redisError
+			if errors.As(err, &re) {
+				items[i] = re
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nuric/go-web-app-template/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/* SQLLimiterStore keeps buckets in the models.RateLimitBucket table. Rows are
+ * read and written back with their version so concurrent requests from other
+ * replicas can't overwrite each other's tokens, the loser reads the bucket
+ * again and retries. Rejected requests don't write at all, which keeps the
+ * load an attacker can put on the database to reads. */
+
+type SQLLimiterStore struct {
+	DB *gorm.DB
+}
+
+func (s SQLLimiterStore) Take(ctx context.Context, key string, p Policy, now time.Time) (bool, float64, error) {
+	now = now.UTC()
+	db := s.DB.WithContext(ctx)
+	return retryTake(ctx, func() (bool, bool, float64, error) {
+		var b models.RateLimitBucket
+		err := db.Where("bucket = ?", key).Take(&b).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			allowed, tokens := take(0, now, now, p, false)
+			res := db.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&models.RateLimitBucket{Bucket: key, Tokens: tokens, LastSeen: now})
+			if res.Error != nil {
+				return false, false, 0, res.Error
+			}
+			// Otherwise another request created it first
+			return res.RowsAffected == 1, allowed, tokens, nil
+		}
+		if err != nil {
+			return false, false, 0, err
+		}
+		allowed, tokens := take(b.Tokens, b.LastSeen, now, p, true)
+		if !allowed {
+			return true, false, tokens, nil
+		}
+		res := db.Model(&models.RateLimitBucket{}).
+			Where("bucket = ? AND version = ?", key, b.Version).
+			Updates(map[string]any{"tokens": tokens, "last_seen": now, "version": b.Version + 1})
+		if res.Error != nil {
+			return false, false, 0, res.Error
+		}
+		return res.RowsAffected == 1, true, tokens, nil
+	})
+}
+
+func (s SQLLimiterStore) Cleanup(ctx context.Context, before time.Time) error {
+	return s.DB.WithContext(ctx).Where("last_seen < ?", before.UTC()).Delete(&models.RateLimitBucket{}).Error
+}
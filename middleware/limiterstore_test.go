@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestLimiterStores(t *testing.T) {
+	stores := []struct {
+		name     string
+		newStore func(t *testing.T) LimiterStore
+	}{
+		{"Memory", func(t *testing.T) LimiterStore { return &MemoryLimiterStore{} }},
+		{"SQL", func(t *testing.T) LimiterStore {
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "limits.db")+"?_pragma=busy_timeout(5000)"), &gorm.Config{})
+			require.NoError(t, err)
+			require.NoError(t, db.AutoMigrate(&models.RateLimitBucket{}))
+			return SQLLimiterStore{DB: db}
+		}},
+		{"Redis", func(t *testing.T) LimiterStore {
+			_, addr := newFakeRedis(t, "secret")
+			s := &RedisLimiterStore{Addr: addr, Password: "secret"}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}},
+	}
+	tests := []struct {
+		name string
+		test func(t *testing.T, s LimiterStore)
+	}{
+		{"Take", testStoreTake},
+		{"Refill", testStoreRefill},
+		{"Cleanup", testStoreCleanup},
+		{"Concurrent", testStoreConcurrent},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.test(t, st.newStore(t))
+				})
+			}
+		})
+	}
+}
+
+var storePolicy = Policy{Name: "test", Requests: 3, Window: time.Minute}
+
+func testStoreTake(t *testing.T, s LimiterStore) {
+	ctx := context.Background()
+	now := time.Now()
+	for _, want := range []float64{2, 1, 0} {
+		allowed, tokens, err := s.Take(ctx, "a", storePolicy, now)
+		require.NoError(t, err)
+		require.True(t, allowed)
+		require.InDelta(t, want, tokens, 1e-9)
+	}
+	allowed, tokens, err := s.Take(ctx, "a", storePolicy, now)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.InDelta(t, 0, tokens, 1e-9)
+	// Other keys have their own bucket
+	allowed, tokens, err = s.Take(ctx, "b", storePolicy, now)
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.InDelta(t, 2, tokens, 1e-9)
+}
+
+func testStoreRefill(t *testing.T, s LimiterStore) {
+	ctx := context.Background()
+	now := time.Now()
+	for range 3 {
+		_, _, err := s.Take(ctx, "a", storePolicy, now)
+		require.NoError(t, err)
+	}
+	// A token every 20 seconds
+	allowed, tokens, err := s.Take(ctx, "a", storePolicy, now.Add(10*time.Second))
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.InDelta(t, 0.5, tokens, 1e-9)
+	allowed, tokens, err = s.Take(ctx, "a", storePolicy, now.Add(30*time.Second))
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.InDelta(t, 0.5, tokens, 1e-9)
+	// Never more than Requests
+	allowed, tokens, err = s.Take(ctx, "a", storePolicy, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.InDelta(t, 2, tokens, 1e-9)
+}
+
+func testStoreCleanup(t *testing.T, s LimiterStore) {
+	ctx := context.Background()
+	now := time.Now()
+	for range 3 {
+		_, _, err := s.Take(ctx, "a", storePolicy, now)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Cleanup(ctx, now.Add(-time.Minute)))
+	allowed, _, err := s.Take(ctx, "a", storePolicy, now)
+	require.NoError(t, err)
+	require.False(t, allowed, "recent buckets are kept")
+	// Forgotten or not, the bucket is full after a window
+	require.NoError(t, s.Cleanup(ctx, now.Add(2*time.Minute)))
+	allowed, tokens, err := s.Take(ctx, "a", storePolicy, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.InDelta(t, 2, tokens, 1e-9)
+}
+
+func testStoreConcurrent(t *testing.T, s LimiterStore) {
+	p := Policy{Name: "test", Requests: 10, Window: time.Hour}
+	now := time.Now()
+	var allowedCount atomic.Int32
+	var wg sync.WaitGroup
+	for range 30 {
+		wg.Go(func() {
+			allowed, _, err := s.Take(context.Background(), "a", p, now)
+			// require can't stop the test from another goroutine
+			assert.NoError(t, err)
+			if allowed {
+				allowedCount.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	// Contention may reject a few early but never lets more through
+	require.LessOrEqual(t, allowedCount.Load(), int32(10))
+	require.Positive(t, allowedCount.Load())
+}
+
+func TestRetryTake(t *testing.T) {
+	tests := []struct {
+		name     string
+		doneAt   int
+		cancel   bool
+		wantErr  error
+		want     bool
+		wantCall int
+	}{
+		{"FirstAttempt", 1, false, nil, true, 1},
+		{"LastAttempt", limiterAttempts, false, nil, true, limiterAttempts},
+		// Rejected rather than an error which would let it through
+		{"Contention", 0, false, nil, false, limiterAttempts},
+		{"Cancelled", 0, true, context.Canceled, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			calls := 0
+			allowed, tokens, err := retryTake(ctx, func() (bool, bool, float64, error) {
+				calls++
+				if tt.cancel {
+					cancel()
+				}
+				return calls == tt.doneAt, true, 2, nil
+			})
+			require.Equal(t, tt.wantCall, calls)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				require.False(t, allowed)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, allowed)
+			if tt.want {
+				require.Equal(t, 2.0, tokens)
+			}
+		})
+	}
+}
+
+// A bucket that keeps changing is being hammered, so requests are rejected
+// rather than let through like on store errors.
+func TestRateLimiter_Contention(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "limits.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.RateLimitBucket{}))
+	p := Policy{Name: "p", Requests: 100, Window: time.Minute}
+	// Every read sees a version another request has already replaced
+	require.NoError(t, db.Callback().Query().After("gorm:query").Register("bump", func(tx *gorm.DB) {
+		if b, ok := tx.Statement.Dest.(*models.RateLimitBucket); ok {
+			b.Version--
+		}
+	}))
+	store := SQLLimiterStore{DB: db}
+	_, _, err = store.Take(context.Background(), "p|ip:192.0.2.1", p, time.Now())
+	require.NoError(t, err)
+	allowed, _, err := store.Take(context.Background(), "p|ip:192.0.2.1", p, time.Now())
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	rl := NewRateLimiter(store, time.Hour)
+	t.Cleanup(rl.Stop)
+	limited := rl.Limit(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1"
+	w := httptest.NewRecorder()
+	limited.ServeHTTP(w, r)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestRedisLimiterStore(t *testing.T) {
+	f, addr := newFakeRedis(t, "secret")
+	s := &RedisLimiterStore{Addr: addr, Password: "secret", Prefix: "app:"}
+	t.Cleanup(func() { s.Close() })
+	_, _, err := s.Take(context.Background(), "auth|ip:192.0.2.1", storePolicy, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, time.Minute+time.Millisecond, f.ttl("app:auth|ip:192.0.2.1"))
+	// Connections are reused
+	require.Len(t, s.idle, 1)
+
+	wrong := &RedisLimiterStore{Addr: addr, Password: "wrong"}
+	_, _, err = wrong.Take(context.Background(), "a", storePolicy, time.Now())
+	require.ErrorContains(t, err, "WRONGPASS")
+
+	unreachable := &RedisLimiterStore{Addr: "127.0.0.1:1"}
+	_, _, err = unreachable.Take(context.Background(), "a", storePolicy, time.Now())
+	require.ErrorContains(t, err, "connect to redis")
+}
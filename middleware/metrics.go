@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuric/go-web-app-template/metrics"
+)
+
+var (
+	httpRequests = metrics.Default.Counter("http_requests_total",
+		"HTTP requests by route pattern and status.", "route", "status")
+	httpDuration = metrics.Default.Histogram("http_request_duration_seconds",
+		"HTTP request latency by route pattern and status.", nil, "route", "status")
+)
+
+// Metrics counts requests and their latency by route pattern and status. It
+// must wrap the ServeMux itself because the mux sets the pattern on the
+// request it is given and middleware in between hands on copies.
+func Metrics(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{passthrough: passthrough{w}}
+		returned := false
+		defer func() {
+			route := r.Pattern
+			if route == "" {
+				// Keeps scanners probing random paths to a single series
+				route = "unmatched"
+			}
+			status := strconv.Itoa(rec.finalStatus(returned))
+			httpRequests.Inc(route, status)
+			httpDuration.Observe(time.Since(start).Seconds(), route, status)
+		}()
+		mux.ServeHTTP(rec, r)
+		returned = true
+	})
+}
+
+// BearerToken only lets through requests with Authorization: Bearer <token>,
+// e.g. Prometheus scraping with authorization credentials set. An empty token
+// lets nobody through.
+func BearerToken(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nuric/go-web-app-template/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeDefault(t *testing.T) string {
+	w := httptest.NewRecorder()
+	metrics.Default.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := Metrics(mux)
+	for _, path := range []string{"/metrics-test/1", "/metrics-test/2", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	require.Panics(t, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics-test/panic", nil))
+	})
+	body := scrapeDefault(t)
+	require.Contains(t, body, `http_requests_total{route="GET /metrics-test/{id}",status="202"} 2`+"\n")
+	require.Contains(t, body, `http_requests_total{route="GET /metrics-test/{id}",status="500"} 1`+"\n")
+	require.Contains(t, body, `http_requests_total{route="unmatched",status="404"}`)
+	require.Contains(t, body, `http_request_duration_seconds_count{route="GET /metrics-test/{id}",status="202"} 2`+"\n")
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"Valid", "secret", "Bearer secret", http.StatusOK},
+		{"Wrong", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"Missing", "secret", "", http.StatusUnauthorized},
+		{"Basic", "secret", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"EmptyToken", "", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := BearerToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tt.token)
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, tt.want, w.Code)
+			if tt.want == http.StatusUnauthorized {
+				require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -1,61 +1,79 @@
 package middleware
 
 import (
+	"context"
+	"io"
 	"log/slog"
-	"net"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/nuric/go-web-app-template/metrics"
+	"github.com/nuric/go-web-app-template/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func ClientIP(r *http.Request) string {
-	// Assume a trusted proxy is in front the application like a load balancer
-	// or reverse proxy. If you don't have such a proxy, you cannot trust the
-	// X-Forwarded-For header and should use r.RemoteAddr directly.
-	var ip string
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ip = strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
-	} else {
-		var err error
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			ip = r.RemoteAddr
-		}
-	}
-	// Parse and normalise the IP address
-	netIP := net.ParseIP(ip)
-	if netIP == nil {
-		slog.Warn("failed to parse IP address", "ip", ip)
-		return "unknown"
-	}
-	return netIP.String()
+/* Different routes need different limits, a login form should allow far
+ * fewer attempts than the chunks of a resumable upload. A Policy describes one
+ * limit and who it counts against, and is attached to a route or group of
+ * routes with RateLimiter.Limit. Each policy keeps its own buckets so a busy
+ * upload does not eat into the login attempts of the same user.
+ *
+ * Limits are token buckets holding Requests tokens which refill evenly over
+ * the Window. Responses carry the RateLimit-* headers from the IETF draft
+ * https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/ and
+ * rejected requests get a Retry-After header. */
+
+var rateLimitRejections = metrics.Default.Counter("rate_limit_rejections_total",
+	"Requests rejected by the rate limiter by policy.", "policy")
+
+// KeyFunc returns who a request counts against. An empty key falls back to
+// the client IP. Keys must come from something the client cannot pick freely,
+// such as the authenticated user, or rotating it would reset the limit.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests against the client IP, see ClientIP.
+func KeyByIP(r *http.Request) string {
+	return "ip:" + ClientIP(r)
+}
+
+// Policy allows Requests per Window for each key, all of which may be used at
+// once.
+type Policy struct {
+	// Identifies the policy in logs, must be unique per RateLimiter
+	Name     string
+	Requests int
+	Window   time.Duration
+	// Defaults to KeyByIP
+	Key KeyFunc
 }
 
-// A client holds the rate limiter and the last seen time for a given IP.
-type client struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
+func (p Policy) perSecond() float64 {
+	return float64(p.Requests) / p.Window.Seconds()
 }
 
-// RateLimiter stores the rate limiters for each client.
+// RateLimiter applies policies with the buckets kept in its store.
 type RateLimiter struct {
-	mu      sync.Mutex
-	clients map[string]*client
-	rate    rate.Limit
-	burst   int
-	expiry  time.Duration
+	store  LimiterStore
+	expiry time.Duration
+	stop   chan struct{}
+	once   sync.Once
 }
 
-// NewRateLimiter creates a new rate limiter with a background cleanup goroutine.
-func NewRateLimiter(eventsPerSecond float64, burst int, expiry time.Duration) *RateLimiter {
+// NewRateLimiter creates a new rate limiter with a background cleanup
+// goroutine that forgets clients not seen for expiry. Call Stop to end it.
+// Buckets are kept in memory when store is nil.
+func NewRateLimiter(store LimiterStore, expiry time.Duration) *RateLimiter {
+	if store == nil {
+		store = &MemoryLimiterStore{}
+	}
 	rl := &RateLimiter{
-		clients: make(map[string]*client),
-		rate:    rate.Limit(eventsPerSecond),
-		burst:   burst,
-		expiry:  expiry,
+		store:  store,
+		expiry: expiry,
+		stop:   make(chan struct{}),
 	}
 
 	// Start a background goroutine to run cleanup periodically.
@@ -64,26 +82,57 @@ func NewRateLimiter(eventsPerSecond float64, burst int, expiry time.Duration) *R
 	return rl
 }
 
-func (rl *RateLimiter) Limit(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := ClientIP(r)
-
-		rl.mu.Lock()
-		c, exists := rl.clients[ip]
-		if !exists {
-			// Create a new limiter for the client.
-			c = &client{
-				limiter: rate.NewLimiter(rl.rate, rl.burst),
+// Stop ends the background cleanup and closes the store if it can be,
+// limits still apply afterwards.
+func (rl *RateLimiter) Stop() {
+	rl.once.Do(func() {
+		close(rl.stop)
+		if c, ok := rl.store.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				slog.Error("could not close rate limit store", "error", err)
 			}
-			rl.clients[ip] = c
 		}
-		// Update the last seen time on every request.
-		c.lastSeen = time.Now()
-		rl.mu.Unlock()
+	})
+}
+
+// Limit applies the policy to every request to next.
+func (rl *RateLimiter) Limit(p Policy, next http.Handler) http.Handler {
+	keyFunc := p.Key
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	if p.Window > rl.expiry {
+		// Forgetting a client early would refill its bucket
+		slog.Warn("rate limit window exceeds client expiry", "policy", p.Name, "window", p.Window, "expiry", rl.expiry)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := keyFunc(r)
+		if key == "" {
+			key = KeyByIP(r)
+		}
+		ctx, span := tracing.Tracer().Start(r.Context(), "ratelimit.take", trace.WithAttributes(attribute.String("ratelimit.policy", p.Name)))
+		allowed, tokens, err := rl.store.Take(ctx, p.Name+"|"+key, p, time.Now())
+		span.SetAttributes(attribute.Bool("ratelimit.allowed", allowed))
+		tracing.End(span, err)
+		if err != nil {
+			// Better to let requests through than to take the site down
+			slog.ErrorContext(r.Context(), "could not check rate limit", "error", err, "policy", p.Name)
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if !c.limiter.Allow() {
-			slog.Warn("rate limit exceeded", "ip", ip)
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		perSecond := p.perSecond()
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(p.Requests))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(tokens)))))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(p.Requests)-tokens)/perSecond))))
+		h.Set("RateLimit-Policy", strconv.Itoa(p.Requests)+";w="+strconv.Itoa(int(p.Window.Seconds())))
+		if !allowed {
+			retryAfter := int(math.Ceil((1 - tokens) / perSecond))
+			h.Set("Retry-After", strconv.Itoa(retryAfter))
+			rateLimitRejections.Inc(p.Name)
+			slog.WarnContext(r.Context(), "rate limit exceeded", "policy", p.Name, "key", key, "uri", r.RequestURI)
+			writeError(w, r, http.StatusTooManyRequests, "", "")
 			return
 		}
 
@@ -97,15 +146,17 @@ func (rl *RateLimiter) backgroundCleanup() {
 	defer ticker.Stop()
 
 	slog.Debug("Starting background cleanup for rate limiter")
-	for range ticker.C {
-		rl.mu.Lock()
-		slog.Debug("Running background cleanup for rate limiter", "clients", len(rl.clients))
-		for ip, c := range rl.clients {
-			// If the client hasn't been seen in the expiry window, delete it.
-			if time.Since(c.lastSeen) > rl.expiry {
-				delete(rl.clients, ip)
-			}
+	for {
+		select {
+		case <-rl.stop:
+			slog.Debug("Stopped background cleanup for rate limiter")
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := rl.store.Cleanup(ctx, time.Now().Add(-rl.expiry)); err != nil {
+			slog.Error("could not clean up rate limits", "error", err)
 		}
-		rl.mu.Unlock()
+		cancel()
 	}
 }
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(nil, time.Hour)
+	t.Cleanup(rl.Stop)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	login := rl.Limit(Policy{Name: "login", Requests: 2, Window: time.Minute}, ok)
+	other := rl.Limit(Policy{Name: "other", Requests: 2, Window: time.Minute}, ok)
+	request := func(h http.Handler, remote string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(login, "192.0.2.1:1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	require.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+	require.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	require.Empty(t, w.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, request(login, "192.0.2.1:2", nil).Code)
+
+	w = request(login, "192.0.2.1:3", nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	require.Equal(t, "30", w.Header().Get("Retry-After"))
+	require.Contains(t, w.Body.String(), "Too Many Requests")
+	require.NotContains(t, w.Body.String(), "<html")
+
+	// Browsers get a page
+	w = request(login, "192.0.2.1:4", http.Header{"Accept": {"text/html,application/xhtml+xml"}})
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), "Please wait 30s")
+	require.Contains(t, scrapeDefault(t), `rate_limit_rejections_total{policy="login"}`)
+
+	// Other clients and policies have their own buckets
+	require.Equal(t, http.StatusOK, request(login, "192.0.2.2:1", nil).Code)
+	require.Equal(t, http.StatusOK, request(other, "192.0.2.1:1", nil).Code)
+}
+
+func TestRateLimiter_Key(t *testing.T) {
+	rl := NewRateLimiter(nil, time.Hour)
+	t.Cleanup(rl.Stop)
+	// Keys on a header set by authentication upstream, never on what the
+	// client sent
+	byUser := func(r *http.Request) string {
+		if user := r.Header.Get("X-Test-User"); user != "" {
+			return "user:" + user
+		}
+		return ""
+	}
+	api := rl.Limit(Policy{Name: "api", Requests: 1, Window: time.Minute, Key: byUser}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"User", http.Header{"X-Test-User": {"a"}}, http.StatusOK},
+		{"UserAgain", http.Header{"X-Test-User": {"a"}}, http.StatusTooManyRequests},
+		{"UserRotatedToken", http.Header{"X-Test-User": {"a"}, "Authorization": {"Bearer b"}}, http.StatusTooManyRequests},
+		{"OtherUser", http.Header{"X-Test-User": {"b"}}, http.StatusOK},
+		// Without a user we fall back to the IP, whatever token is sent
+		{"Guest", http.Header{"Authorization": {"Bearer a"}}, http.StatusOK},
+		{"GuestRotatedToken", http.Header{"Authorization": {"Bearer b"}}, http.StatusTooManyRequests},
+		{"GuestRotatedAPIKey", http.Header{"X-Api-Key": {"c"}}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			require.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestRateLimiter_Stop(t *testing.T) {
+	store := &MemoryLimiterStore{}
+	rl := NewRateLimiter(store, time.Millisecond)
+	limited := rl.Limit(Policy{Name: "p", Requests: 1, Window: time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	limited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.buckets) == 0
+	}, time.Second, time.Millisecond)
+	rl.Stop()
+	// Stopping twice is fine
+	rl.Stop()
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, p Policy, now time.Time) (bool, float64, error) {
+	return false, 0, errors.New("store unavailable")
+}
+
+func (failingStore) Cleanup(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func TestRateLimiter_StoreError(t *testing.T) {
+	rl := NewRateLimiter(failingStore{}, time.Hour)
+	t.Cleanup(rl.Stop)
+	limited := rl.Limit(Policy{Name: "p", Requests: 1, Window: time.Minute}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 3 {
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nuric/go-web-app-template/requestid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var got string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestid.FromContext(r.Context())
+	}))
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"Generated", "", false},
+		{"Propagated", "lb-1234", true},
+		{"Invalid", "bad id\r\nX-Injected: 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				r.Header.Set(requestid.Header, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.NotEmpty(t, got)
+			require.Equal(t, got, w.Header().Get(requestid.Header))
+			if tt.keep {
+				require.Equal(t, tt.incoming, got)
+			} else {
+				require.NotEqual(t, tt.incoming, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+/* Middleware that wraps the ResponseWriter hides the optional interfaces of
+ * the one it wraps, e.g. a handler streaming with http.Flusher would stop
+ * flushing. passthrough restores them by delegating through an
+ * http.ResponseController, which reports http.ErrNotSupported when the
+ * underlying writer lacks the feature, and Unwrap lets ResponseController
+ * users reach the original writer. Wrappers embed it and override only what
+ * they need to observe. */
+
+type passthrough struct {
+	http.ResponseWriter
+}
+
+func (p passthrough) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+func (p passthrough) Flush() {
+	_ = http.NewResponseController(p.ResponseWriter).Flush()
+}
+
+func (p passthrough) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(p.ResponseWriter).Hijack()
+}
+
+func (p passthrough) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := p.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
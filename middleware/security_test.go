@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		hsts bool
+	}{
+		{"Production", true},
+		{"Debug", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nonce string
+			h := SecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nonce = CSPNonce(r)
+			}), tt.hsts)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			require.NotEmpty(t, nonce)
+			csp := w.Header().Get("Content-Security-Policy")
+			require.Contains(t, csp, "script-src 'nonce-"+nonce+"' 'strict-dynamic'")
+			require.Contains(t, csp, "frame-ancestors 'none'")
+			require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+			require.Equal(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"))
+			require.NotEmpty(t, w.Header().Get("Permissions-Policy"))
+			require.Equal(t, tt.hsts, w.Header().Get("Strict-Transport-Security") != "")
+		})
+	}
+}
+
+func TestSecurityHeaders_NonceIsPerRequest(t *testing.T) {
+	seen := map[string]bool{}
+	h := SecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen[CSPNonce(r)] = true
+	}), false)
+	for range 10 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	require.Len(t, seen, 10)
+	require.Empty(t, CSPNonce(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestSecurityHeaders_ErrorPageNonce(t *testing.T) {
+	h := SecurityHeaders(ErrorPageRenderer(http.NotFoundHandler()), false)
+	r := httptest.NewRequest("GET", "/nowhere", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Body.String(), `<script nonce="`)
+	require.NotContains(t, w.Body.String(), `<script nonce=""`)
+	require.NotContains(t, w.Body.String(), "onclick")
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/nuric/go-web-app-template/requestid"
+	"github.com/nuric/go-web-app-template/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* Trace starts the server span of a request and the spans of everything the
+ * request does hang off it. Like the access log it can't see the route the
+ * mux matched, so the span is named after the method until SetRoute is called
+ * from inside the mux. TraceLayer adds a span for a middleware to show where
+ * the time goes on the way to the handler. */
+
+type serverSpanKey struct{}
+
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Continue the caller's trace if it sent a traceparent header
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(ClientIP(r)),
+			))
+		if id := requestid.FromContext(ctx); id != "" {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+		rec := &accessRecorder{passthrough: passthrough{w}}
+		r = r.WithContext(context.WithValue(ctx, serverSpanKey{}, span))
+		returned := false
+		defer func() {
+			status := rec.finalStatus(returned)
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			span.End()
+		}()
+		next.ServeHTTP(rec, r)
+		returned = true
+	})
+}
+
+// SetRoute names the request after the route pattern the mux matched, in the
+// access log and the trace. Call it with the request the mux handed on.
+func SetRoute(r *http.Request) {
+	AnnotateAccessLog(r.Context(), slog.String("route", r.Pattern))
+	span, ok := r.Context().Value(serverSpanKey{}).(trace.Span)
+	if !ok || r.Pattern == "" {
+		return
+	}
+	span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+	// Patterns may start with the method already, e.g. "GET /{$}"
+	if strings.Contains(r.Pattern, " ") {
+		span.SetName(r.Pattern)
+		return
+	}
+	span.SetName(r.Method + " " + r.Pattern)
+}
+
+// TraceLayer runs next in a span called name.
+func TraceLayer(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Tracer().Start(r.Context(), name)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nuric/go-web-app-template/requestid"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		tp.Shutdown(context.Background())
+	})
+	return exp
+}
+
+func spanAttr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTrace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	mux.HandleFunc("POST /items", func(w http.ResponseWriter, r *http.Request) {})
+	// Like the controllers, the route is set from inside the layers
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer SetRoute(r)
+		mux.ServeHTTP(w, r)
+	})
+	h := RequestID(Trace(TraceLayer("middleware.test", routed)))
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		span   string
+		status codes.Code
+	}{
+		{"Route", "GET", "/items/1", "GET /items/{id}", codes.Unset},
+		{"MethodPattern", "POST", "/items", "POST /items", codes.Unset},
+		{"Unmatched", "GET", "/nowhere", "GET", codes.Unset},
+		{"ServerError", "GET", "/items/broken", "GET /items/{id}", codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp := recordSpans(t)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			spans := exp.GetSpans()
+			require.Len(t, spans, 2)
+			layer, server := spans[0], spans[1]
+			require.Equal(t, "middleware.test", layer.Name)
+			require.Equal(t, server.SpanContext.SpanID(), layer.Parent.SpanID())
+			require.False(t, server.Parent.IsValid())
+			require.Equal(t, tt.span, server.Name)
+			require.Equal(t, tt.status, server.Status.Code)
+			require.Equal(t, int64(w.Code), spanAttr(server, "http.response.status_code").AsInt64())
+			require.Equal(t, w.Header().Get(requestid.Header), spanAttr(server, "request_id").AsString())
+		})
+	}
+}
+
+func TestTrace_Propagation(t *testing.T) {
+	exp := recordSpans(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+}
@@ -0,0 +1,16 @@
+package models
+
+import "gorm.io/gorm"
+
+const (
+	AuditUploadQuarantined = "upload_quarantined"
+	AuditUploadNotScanned  = "upload_not_scanned"
+)
+
+// AuditEvent records a security relevant event for administrators to review.
+type AuditEvent struct {
+	gorm.Model
+	UserID uint   `gorm:"index"`          // Who caused it, if anyone
+	Action string `gorm:"index;not null"` // e.g., "upload_quarantined"
+	Detail string
+}
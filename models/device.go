@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// KnownDevice is a user agent and network the user has logged in from
+// before. Logins that don't match any known device trigger a security email.
+type KnownDevice struct {
+	gorm.Model
+	UserID     uint   `gorm:"index;not null"`
+	UserAgent  string `gorm:"not null"`
+	IPPrefix   string `gorm:"not null"` // e.g., "203.0.113.0/24"
+	Location   string // Country or region from the GeoIP database, if any
+	LastIP     string
+	LastSeenAt time.Time
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// RateLimitBucket is the token bucket of one client under one rate limit
+// policy, shared by every instance of the application.
+type RateLimitBucket struct {
+	Bucket   string    `gorm:"primaryKey"` // Policy and client, e.g., "auth|ip:192.0.2.1"
+	Tokens   float64   `gorm:"not null"`
+	LastSeen time.Time `gorm:"index;not null"`     // When Tokens was last refilled, in UTC
+	Version  int64     `gorm:"not null;default:0"` // Guards concurrent updates
+}
@@ -0,0 +1,13 @@
+package models
+
+import "gorm.io/gorm"
+
+// Suppression records an email address we must not send to anymore because it
+// hard bounced or the recipient complained.
+type Suppression struct {
+	gorm.Model
+	Email    string `gorm:"uniqueIndex;not null"` // Stored in lower case
+	Reason   string `gorm:"not null"`             // e.g., "bounce", "complaint"
+	Provider string // Which webhook reported it
+	Detail   string
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	VisibilityPublic  = "public"  // Anyone with the link
+	VisibilityPrivate = "private" // Only the owner
+	VisibilityShared  = "shared"  // The owner and users in UploadShare
+)
+
+// Upload records a file in the Storer and who may read it.
+type Upload struct {
+	gorm.Model
+	Path        string `gorm:"uniqueIndex;not null"` // Path in the Storer, e.g., profile/<uuid>_512.png
+	OwnerID     uint   `gorm:"index;not null"`
+	Visibility  string `gorm:"not null;default:'private'"`
+	ContentType string `gorm:"not null"`
+	Size        int64
+	// Uploads stored together, e.g. the sizes of a profile picture, share a
+	// group so they are kept or collected together
+	Group  string `gorm:"index"`
+	Shares []UploadShare
+}
+
+// UploadShare grants a user read access to a shared upload.
+type UploadShare struct {
+	gorm.Model
+	UploadID uint `gorm:"uniqueIndex:idx_upload_share;not null"`
+	UserID   uint `gorm:"uniqueIndex:idx_upload_share;not null"`
+}
+
+// ResumableUpload tracks a tus upload while its chunks arrive. Once complete
+// the chunks are joined into a file recorded as an Upload.
+type ResumableUpload struct {
+	gorm.Model
+	UUID      string    `gorm:"uniqueIndex;not null"` // Used in the upload URL
+	OwnerID   uint      `gorm:"index;not null"`
+	Size      int64     `gorm:"not null"`
+	Received  int64     `gorm:"not null;default:0"` // The tus upload offset
+	Filename  string    // Client supplied, for display only
+	ExpiresAt time.Time `gorm:"index;not null"`
+	UploadID  uint      // Set once complete
+}
+
+// ResumableChunk is a stored chunk of a ResumableUpload. Requests racing for
+// the same offset each store their own chunk but only one gets a row, so only
+// chunks with a row are part of the upload.
+type ResumableChunk struct {
+	ID                uint `gorm:"primarykey"`
+	CreatedAt         time.Time
+	ResumableUploadID uint   `gorm:"uniqueIndex:idx_resumable_chunk;not null"`
+	Start             int64  `gorm:"uniqueIndex:idx_resumable_chunk;not null"` // Upload offset of the first byte
+	Path              string `gorm:"not null"`                                 // e.g., tus/<uuid>/<offset>-<random>
+	Size              int64  `gorm:"not null"`
+}
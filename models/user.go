@@ -14,6 +14,10 @@ type User struct {
 	EmailVerified bool   `gorm:"default:false"`
 	Name          string
 	Picture       string
+	// Locked accounts cannot log in until the password is reset
+	Locked bool `gorm:"default:false"`
+	// Bytes the user may store, overrides the quota of their role when set
+	StorageQuota int64
 }
 
 type Token struct {
@@ -21,6 +25,6 @@ type Token struct {
 	UserID    uint      // For tokens that are user-specific
 	Email     string    // Optional, for tokens that are not user-specific
 	Token     string    `gorm:"uniqueIndex;not null"`
-	Purpose   string    `gorm:"not null"` // e.g., "password_reset", "email_verification"
+	Purpose   string    `gorm:"not null"` // e.g., "password_reset", "email_verification", "undo_email_change", "api"
 	ExpiresAt time.Time `gorm:"not null"`
 }
@@ -0,0 +1,48 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{New(), true},
+		{"Root=1-67891233-abcdef012345678912345678", true},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{string(bytes.Repeat([]byte("a"), 129)), false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, Valid(tt.id), tt.id)
+	}
+	require.Len(t, New(), 32)
+	require.NotEqual(t, New(), New())
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(LogHandler{slog.NewTextHandler(&buf, nil)})
+	ctx := NewContext(context.Background(), "abc123")
+	logger.InfoContext(ctx, "with id")
+	require.Contains(t, buf.String(), "request_id=abc123")
+
+	buf.Reset()
+	logger.Info("without id")
+	require.NotContains(t, buf.String(), "request_id")
+
+	// Derived loggers keep adding it
+	buf.Reset()
+	logger.With("userId", 1).WithGroup("g").InfoContext(ctx, "derived", "k", "v")
+	require.Contains(t, buf.String(), "userId=1")
+	require.Contains(t, buf.String(), "g.request_id=abc123")
+	require.Equal(t, "", FromContext(context.Background()))
+}
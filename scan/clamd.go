@@ -0,0 +1,131 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+/* ClamdScanner streams content to a ClamAV daemon with the INSTREAM command.
+ * https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+ *
+ * The content is sent in chunks each prefixed with its length as a 4 byte big
+ * endian integer and a zero length chunk ends the stream. clamd replies with
+ * a single line such as "stream: OK" or "stream: Eicar-Signature FOUND". We
+ * use the z prefixed form of the command so the reply ends with a null byte.
+ *
+ * clamd refuses streams longer than StreamMaxLength in clamd.conf, 25MB by
+ * default, counting the whole stream rather than each chunk. MaxSize must
+ * match it. We stop at MaxSize ourselves and report ErrTooLarge, which is
+ * also what a refusal from clamd is reported as, so callers can tell content
+ * that is too large from a failing scanner. */
+
+// Size of the chunks we send, any size works as far as clamd is concerned
+const clamdChunkSize = 64 * 1024
+
+// The default of StreamMaxLength in clamd.conf
+const DefaultClamdMaxSize = 25 * 1024 * 1024
+
+type ClamdScanner struct {
+	// Network and address of clamd, e.g. "unix" and "/run/clamav/clamd.ctl"
+	// or "tcp" and "localhost:3310"
+	Network string
+	Address string
+	// Timeout for a whole scan, defaults to a minute
+	Timeout time.Duration
+	// Largest content clamd accepts, StreamMaxLength in clamd.conf. Defaults
+	// to DefaultClamdMaxSize.
+	MaxSize int64
+}
+
+// Limit returns the largest content the scanner accepts.
+func (c ClamdScanner) Limit() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return DefaultClamdMaxSize
+}
+
+func (c ClamdScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return Result{}, err
+	}
+	if err := c.stream(conn, r); errors.Is(err, ErrTooLarge) {
+		return Result{}, err
+	} else if err != nil {
+		// clamd replies and hangs up when the stream is too large, so the
+		// reply explains the failed write better than the write error
+		if res, replyErr := readClamdReply(conn); replyErr != nil || res.Infected {
+			return res, replyErr
+		}
+		return Result{}, fmt.Errorf("stream to clamd: %w", err)
+	}
+	return readClamdReply(conn)
+}
+
+func (c ClamdScanner) stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	var total int64
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		total += int64(n)
+		if total > c.Limit() {
+			return ErrTooLarge
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read content: %w", err)
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+func readClamdReply(conn net.Conn) (Result, error) {
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString(0)
+	if err != nil && reply == "" {
+		return Result{}, fmt.Errorf("read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		// MaxSize is larger than StreamMaxLength
+		return Result{}, fmt.Errorf("%w: clamd: %s", ErrTooLarge, reply)
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
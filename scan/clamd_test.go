@@ -0,0 +1,183 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The EICAR test file every antivirus flags, split so this file isn't
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD` + `-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd speaks enough of the clamd protocol to answer INSTREAM commands,
+// flagging streams that contain the EICAR string.
+type fakeClamd struct {
+	// Like StreamMaxLength, larger streams are refused
+	maxLength int
+	// Never reply, to test timeouts
+	hang bool
+}
+
+func (f fakeClamd) serve(t *testing.T, network, address string) {
+	l, err := net.Listen(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+}
+
+func (f fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if len(data)+int(size) > f.maxLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+	if f.hang {
+		time.Sleep(time.Second)
+		return
+	}
+	if bytes.Contains(data, []byte(eicar)) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamdScanner(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd{maxLength: 1 << 20}.serve(t, "unix", socket)
+	s := ClamdScanner{Network: "unix", Address: socket}
+	// Spans two chunks so the signature is split between them
+	split := strings.Repeat("a", clamdChunkSize-10) + eicar
+	tests := []struct {
+		name      string
+		content   string
+		infected  bool
+		signature string
+		err       string
+	}{
+		{"Clean", "hello world", false, "", ""},
+		{"Empty", "", false, "", ""},
+		{"Infected", eicar, true, "Eicar-Test-Signature", ""},
+		{"InfectedAcrossChunks", split, true, "Eicar-Test-Signature", ""},
+		{"TooLarge", strings.Repeat("a", 2<<20), false, "", "too large to scan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.Scan(context.Background(), strings.NewReader(tt.content))
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.infected, res.Infected)
+			require.Equal(t, tt.signature, res.Signature)
+		})
+	}
+}
+
+func TestClamdScanner_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	fakeClamd{maxLength: 1 << 20}.serve(t, "tcp", addr)
+	res, err := ClamdScanner{Network: "tcp", Address: addr}.Scan(context.Background(), strings.NewReader(eicar))
+	require.NoError(t, err)
+	require.True(t, res.Infected)
+}
+
+func TestClamdScanner_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := ClamdScanner{Network: "unix", Address: filepath.Join(dir, "missing.sock")}.Scan(context.Background(), strings.NewReader("x"))
+	require.ErrorContains(t, err, "connect to clamd")
+
+	socket := filepath.Join(dir, "hang.sock")
+	fakeClamd{maxLength: 1 << 20, hang: true}.serve(t, "unix", socket)
+	start := time.Now()
+	_, err = ClamdScanner{Network: "unix", Address: socket, Timeout: 100 * time.Millisecond}.Scan(context.Background(), strings.NewReader("x"))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+
+	// A cancelled request stops the scan as well
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ClamdScanner{Network: "unix", Address: socket}.Scan(ctx, strings.NewReader("x"))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestNopScanner(t *testing.T) {
+	res, err := NopScanner{}.Scan(context.Background(), strings.NewReader(eicar))
+	require.NoError(t, err)
+	require.False(t, res.Infected)
+}
+
+func TestClamdScanner_MaxSize(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd{maxLength: 1 << 20}.serve(t, "unix", socket)
+	tests := []struct {
+		name    string
+		maxSize int64
+		size    int
+		err     error
+	}{
+		{"AtLimit", 1 << 20, 1 << 20, nil},
+		// Stopped before anything is sent past the limit
+		{"OverLimit", 1 << 20, 1<<20 + 1, ErrTooLarge},
+		{"OverOwnLimit", 1000, 1001, ErrTooLarge},
+		// MaxSize larger than clamd accepts, clamd refuses it
+		{"OverClamdLimit", 4 << 20, 2 << 20, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := ClamdScanner{Network: "unix", Address: socket, MaxSize: tt.maxSize}
+			_, err := s.Scan(context.Background(), strings.NewReader(strings.Repeat("a", tt.size)))
+			if tt.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+	require.Equal(t, int64(DefaultClamdMaxSize), ClamdScanner{}.Limit())
+}
@@ -0,0 +1,32 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+/* Uploads are scanned before they are committed to the Storer. The Scanner
+ * only reports what it found, what to do with flagged content is up to the
+ * caller. */
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// ErrTooLarge is returned by scanners that refuse content above a size, e.g.
+// ClamdScanner above its MaxSize.
+var ErrTooLarge = errors.New("content is too large to scan")
+
+// Result of a scan, Signature names what was found when Infected.
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// NopScanner reports everything as clean, for when no scanner is configured.
+type NopScanner struct{}
+
+func (NopScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	return Result{}, nil
+}
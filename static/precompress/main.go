@@ -0,0 +1,67 @@
+// Precompress writes .gz and .br variants next to the static assets so they
+// are compressed once at build time instead of on every request. It is run
+// by go generate in the static package.
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/andybalholm/brotli"
+)
+
+func compress(src, dst string, newWriter func(io.Writer) io.WriteCloser) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := newWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory with the assets")
+	flag.Parse()
+	// gzip leaves the modification time out of the header so the output is
+	// the same for the same input and regenerating doesn't show up in diffs
+	writers := map[string]func(io.Writer) io.WriteCloser{
+		".gz": func(w io.Writer) io.WriteCloser {
+			gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return gw
+		},
+		".br": func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		},
+	}
+	files, err := filepath.Glob(filepath.Join(*dir, "*.css"))
+	if err != nil {
+		slog.Error("could not list assets", "error", err)
+		os.Exit(1)
+	}
+	for _, src := range files {
+		for ext, newWriter := range writers {
+			if err := compress(src, src+ext, newWriter); err != nil {
+				slog.Error("could not compress asset", "error", err, "file", src)
+				os.Exit(1)
+			}
+		}
+		slog.Info("Compressed asset", "file", src)
+	}
+}
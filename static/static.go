@@ -4,7 +4,12 @@ import "embed"
 
 /* By embedding the static files, we can serve them directly from the binary.
  * This simplifies the deployment process and avoids copying static files
- * separately. */
+ * separately.
+ *
+ * The .gz and .br variants are served to clients that accept them, run go
+ * generate after changing an asset to bring them up to date. */
 
-//go:embed *.css
+//go:generate go run ./precompress
+
+//go:embed *.css *.css.gz *.css.br
 var FS embed.FS
@@ -0,0 +1,37 @@
+package static
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+// The variants are checked in, this catches an asset changed without running
+// go generate.
+func TestPrecompressedUpToDate(t *testing.T) {
+	assets, err := fs.Glob(FS, "*.css")
+	require.NoError(t, err)
+	require.NotEmpty(t, assets)
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		".gz": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		".br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+	for _, name := range assets {
+		original, err := fs.ReadFile(FS, name)
+		require.NoError(t, err)
+		for ext, newReader := range readers {
+			compressed, err := fs.ReadFile(FS, name+ext)
+			require.NoError(t, err, "run go generate ./static")
+			r, err := newReader(bytes.NewReader(compressed))
+			require.NoError(t, err)
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, original, decoded, "%s%s is stale, run go generate ./static", name, ext)
+		}
+	}
+}
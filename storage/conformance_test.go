@@ -0,0 +1,24 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storers := map[string]func(t *testing.T) storage.Storer{
+		"os":  func(t *testing.T) storage.Storer { return storage.OsStorer{Path: t.TempDir()} },
+		"mem": func(t *testing.T) storage.Storer { return &storage.MemStorer{} },
+		"s3": func(t *testing.T) storage.Storer {
+			s, _ := storage.NewTestS3Storer(t)
+			return s
+		},
+	}
+	for name, newStorer := range storers {
+		t.Run(name, func(t *testing.T) {
+			storagetest.TestStorer(t, newStorer)
+		})
+	}
+}
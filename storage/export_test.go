@@ -0,0 +1,5 @@
+package storage
+
+// NewTestS3Storer lets the conformance tests in storage_test use the fake S3
+// server.
+var NewTestS3Storer = newTestS3Storer
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+/* MemStorer keeps files in memory, for tests and ephemeral environments where
+ * nothing needs to survive a restart. Reads are served by an fstest.MapFS
+ * which already implements fs.FS with seekable files and synthesised folders,
+ * so like S3 a folder only exists while it has files in it. Stored data is
+ * never modified in place, a write replaces the whole entry, which keeps files
+ * opened before a write valid after we release the lock. */
+
+type MemStorer struct {
+	mu    sync.RWMutex
+	files fstest.MapFS
+}
+
+func (m *MemStorer) Name() string {
+	return "mem"
+}
+
+// name cleans and checks a name the same way OsStorer does so both report
+// the same errors.
+func (m *MemStorer) name(op, name string, write bool) (string, error) {
+	clean, err := localName(op, name)
+	if err != nil {
+		return "", err
+	}
+	if write && clean == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return clean, nil
+}
+
+func (m *MemStorer) Open(name string) (fs.File, error) {
+	clean, err := m.name("open", name, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.Open(clean)
+}
+
+func (m *MemStorer) ReadFile(name string) ([]byte, error) {
+	clean, err := m.name("read", name, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.ReadFile(clean)
+}
+
+func (m *MemStorer) Stat(name string) (fs.FileInfo, error) {
+	clean, err := m.name("stat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files.Stat(clean)
+}
+
+func (m *MemStorer) ReadDir(name string) ([]fs.DirEntry, error) {
+	clean, err := m.name("readdir", name, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// An empty MapFS still has a root folder
+	return m.files.ReadDir(clean)
+}
+
+type memWriter struct {
+	bytes.Buffer
+	m      *MemStorer
+	name   string
+	closed bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	return w.Buffer.Write(p)
+}
+
+// Close stores the file, it does not exist until then.
+func (w *memWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.m.WriteFile(w.name, w.Bytes())
+}
+
+func (m *MemStorer) Create(name string) (io.WriteCloser, error) {
+	clean, err := m.name("create", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &memWriter{m: m, name: clean}, nil
+}
+
+func (m *MemStorer) WriteFile(name string, data []byte) error {
+	clean, err := m.name("write", name, true)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.put("write", name, clean, &fstest.MapFile{Data: slices.Clone(data), Mode: 0644, ModTime: time.Now()})
+}
+
+// put stores f under clean, the caller holds the write lock.
+func (m *MemStorer) put(op, name, clean string, f *fstest.MapFile) error {
+	if m.files == nil {
+		m.files = fstest.MapFS{}
+	}
+	// Like on disk a file can't also be a folder
+	for dir := path.Dir(clean); dir != "."; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+		}
+	}
+	if info, err := m.files.Stat(clean); err == nil && info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	m.files[clean] = f
+	return nil
+}
+
+func (m *MemStorer) Remove(name string) error {
+	clean, err := m.name("remove", name, true)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[clean]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	// Parent folders disappear with their last file
+	delete(m.files, clean)
+	return nil
+}
+
+func (m *MemStorer) Rename(oldname, newname string) error {
+	oldClean, err := m.name("rename", oldname, true)
+	if err != nil {
+		return err
+	}
+	newClean, err := m.name("rename", newname, true)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldClean]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if oldClean == newClean {
+		return nil
+	}
+	if err := m.put("rename", newname, newClean, f); err != nil {
+		return err
+	}
+	delete(m.files, oldClean)
+	return nil
+}
+
+func (m *MemStorer) List(prefix, token string, limit int) ([]FileInfo, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var files []FileInfo
+	for _, name := range slices.Sorted(maps.Keys(m.files)) {
+		if !strings.HasPrefix(name, prefix) || name <= token {
+			continue
+		}
+		if len(files) == limit {
+			return files, files[limit-1].Path, nil
+		}
+		f := m.files[name]
+		files = append(files, FileInfo{Path: name, Size: int64(len(f.Data)), ModTime: f.ModTime})
+	}
+	return files, "", nil
+}
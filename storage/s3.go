@@ -0,0 +1,638 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* S3Storer talks to any S3 compatible object store (AWS, MinIO, R2, etc.)
+ * using plain HTTP requests signed with AWS Signature Version 4. We only need
+ * a handful of operations so this keeps the SDK and its dependency tree out
+ * of the binary. */
+
+// S3 rejects multipart parts smaller than this, except the last one.
+const s3MinPartSize = 5 * 1024 * 1024
+
+type S3Storer struct {
+	// Endpoint including the scheme, e.g. https://s3.eu-west-2.amazonaws.com
+	// or http://localhost:9000 for MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket in the path (endpoint/bucket/key) instead of
+	// the host name (bucket.endpoint/key). Most self hosted servers need it.
+	PathStyle bool
+	// PartSize is the size of each multipart upload part used by Create,
+	// defaults to the 5MB minimum.
+	PartSize int
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Now is used for signing and defaults to time.Now
+	Now func() time.Time
+}
+
+func (s S3Storer) Name() string {
+	return fmt.Sprintf("s3: %s/%s", s.Endpoint, s.Bucket)
+}
+
+// ---------------------------
+
+func (s S3Storer) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	resp, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &s3File{s: s, name: name, body: resp.Body, info: s3ResponseInfo(name, resp)}, nil
+}
+
+func s3ResponseInfo(name string, resp *http.Response) s3FileInfo {
+	info := s3FileInfo{name: path.Base(name), size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = t
+	}
+	return info
+}
+
+func (s S3Storer) ReadFile(name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s S3Storer) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = s3MinPartSize
+	}
+	return &s3Writer{s: s, key: name, partSize: partSize}, nil
+}
+
+func (s S3Storer) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	resp, err := s.do(http.MethodPut, name, nil, nil, data)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s S3Storer) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	// S3 happily deletes keys that don't exist, but OsStorer reports them so
+	// we check first to keep the same semantics.
+	resp, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	resp, err = s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies the object server side and deletes the original, S3 has no
+// rename. Objects over 5GB would need a multipart copy.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_CopyObject.html
+func (s S3Storer) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || oldname == "." || !fs.ValidPath(newname) || newname == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	if oldname == newname {
+		_, err := s.Stat(oldname)
+		return err
+	}
+	header := http.Header{"X-Amz-Copy-Source": {s3EscapePath("/" + s.Bucket + "/" + oldname)}}
+	resp, err := s.do(http.MethodPut, newname, nil, header, nil)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	resp.Body.Close()
+	resp, err = s.do(http.MethodDelete, oldname, nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ---------------------------
+// Listing
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (s S3Storer) list(prefix, delimiter, token string, limit int) (s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(limit)}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	var result s3ListResult
+	resp, err := s.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("decode list objects: %w", err)
+	}
+	return result, nil
+}
+
+// dirPrefix turns a folder name into the key prefix of its contents.
+func dirPrefix(name string) string {
+	if name == "." {
+		return ""
+	}
+	return name + "/"
+}
+
+// Stat uses a HEAD request for files. S3 has no folders, so a name is a
+// folder if any key starts with it followed by a slash.
+func (s S3Storer) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s3FileInfo{name: ".", dir: true}, nil
+	}
+	resp, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		return s3ResponseInfo(name, resp), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	result, err := s.list(dirPrefix(name), "", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(result.Contents) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// ReadDir lists one level using the slash as the delimiter, sub folders come
+// back as common prefixes.
+func (s S3Storer) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := dirPrefix(name)
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		result, err := s.list(prefix, "/", token, defaultListLimit)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, p := range result.CommonPrefixes {
+			dir := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: dir, dir: true}))
+		}
+		for _, c := range result.Contents {
+			info := s3FileInfo{name: strings.TrimPrefix(c.Key, prefix), size: c.Size, modTime: c.LastModified}
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// List maps directly onto ListObjectsV2, the token is the S3 continuation
+// token.
+func (s S3Storer) List(prefix, token string, limit int) ([]FileInfo, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	result, err := s.list(prefix, "", token, limit)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: "list", Path: prefix, Err: err}
+	}
+	files := make([]FileInfo, 0, len(result.Contents))
+	for _, c := range result.Contents {
+		files = append(files, FileInfo{Path: c.Key, Size: c.Size, ModTime: c.LastModified})
+	}
+	if !result.IsTruncated {
+		return files, "", nil
+	}
+	return files, result.NextContinuationToken, nil
+}
+
+// ---------------------------
+// Requests
+
+// s3Error is the XML error body returned by S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// objectURL builds the URL of a key. The key is escaped per path segment so
+// that it matches the canonical URI used for signing.
+func (s S3Storer) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint: %w", err)
+	}
+	p := "/" + key
+	if s.PathStyle {
+		p = "/" + s.Bucket + p
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = u.Path + p
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u, nil
+}
+
+func (s S3Storer) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e s3Error
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fs.ErrNotExist
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %s %s", fs.ErrPermission, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, key, resp.Status, e.Code, e.Message)
+}
+
+// ---------------------------
+// AWS Signature Version 4
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+func (s S3Storer) sign(req *http.Request, body []byte) {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	// ---------------------------
+	// Sign every header we set plus the host
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	// ---------------------------
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes everything except the unreserved characters.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// ---------------------------
+// Reading
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// s3File streams the object body. Seeking drops the current body and the next
+// read issues a ranged request, which lets http.FileServerFS serve ranges.
+type s3File struct {
+	s      S3Storer
+	name   string
+	info   s3FileInfo
+	body   io.ReadCloser
+	offset int64
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.s.do(http.MethodGet, f.name, nil, header, nil)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.info.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = abs
+	return abs, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+// ---------------------------
+// Writing
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Writer buffers a part at a time. Small files are sent with a single
+// PutObject on Close, larger ones switch to a multipart upload once the first
+// part fills up.
+type s3Writer struct {
+	s        S3Storer
+	key      string
+	partSize int
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3CompletedPart
+	err      error
+	closed   bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	w.buf.Write(p)
+	for w.buf.Len() >= w.partSize {
+		if err := w.uploadPart(w.buf.Next(w.partSize)); err != nil {
+			w.abort(err)
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("create multipart upload: %w", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("decode multipart upload: %w", err)
+		}
+		w.uploadID = result.UploadID
+	}
+	partNumber := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+	resp, err := w.s.do(http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return fmt.Errorf("upload part %d: %w", partNumber, err)
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// abort records the error and cleans up the parts already uploaded, otherwise
+// S3 keeps charging for them.
+func (w *s3Writer) abort(err error) {
+	w.err = err
+	if w.uploadID == "" {
+		return
+	}
+	resp, abortErr := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if abortErr != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	if w.uploadID == "" {
+		if err := w.s.WriteFile(w.key, w.buf.Bytes()); err != nil {
+			w.err = err
+		}
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.abort(err)
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		w.abort(err)
+		return err
+	}
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		err = fmt.Errorf("complete multipart upload: %w", err)
+		w.abort(err)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
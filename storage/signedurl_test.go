@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLSigner(t *testing.T) {
+	s := URLSigner{Secret: []byte("secret"), Prefix: "/uploads/"}
+	now := time.Now()
+	signed, err := s.Sign("profile/a b.png", now.Add(time.Hour), "attachment; filename=a.png")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(signed, "/uploads/profile/a%20b.png?"))
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	require.True(t, IsSigned(u.Query()))
+
+	disposition, err := s.Verify("profile/a b.png", u.Query(), now)
+	require.NoError(t, err)
+	require.Equal(t, "attachment; filename=a.png", disposition)
+
+	// Expired
+	_, err = s.Verify("profile/a b.png", u.Query(), now.Add(2*time.Hour))
+	require.ErrorIs(t, err, ErrURLExpired)
+
+	// Different path, tampered expiry or disposition, wrong secret
+	_, err = s.Verify("profile/other.png", u.Query(), now)
+	require.ErrorIs(t, err, ErrURLSignature)
+	for key, value := range map[string]string{"expires": "9999999999", "disposition": "inline", "sig": "nope"} {
+		q := u.Query()
+		q.Set(key, value)
+		_, err = s.Verify("profile/a b.png", q, now)
+		require.ErrorIs(t, err, ErrURLSignature, key)
+	}
+	_, err = URLSigner{Secret: []byte("other")}.Verify("profile/a b.png", u.Query(), now)
+	require.ErrorIs(t, err, ErrURLSignature)
+
+	_, err = s.Sign("a.png", now, "attachment; filename=")
+	require.Error(t, err)
+}
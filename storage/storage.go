@@ -1,21 +1,68 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Storer interface {
 	fs.ReadFileFS
+	fs.ReadDirFS
+	fs.StatFS
 	Name() string
 	Create(name string) (io.WriteCloser, error)
 	WriteFile(name string, data []byte) error
 	Remove(name string) error
+	// Rename moves a file to newname, replacing any file already there. Use
+	// it to publish a file only once it is complete.
+	Rename(oldname, newname string) error
+	// List returns up to limit files whose path starts with prefix, in
+	// lexical order. Prefix is matched as a string, not a folder, so
+	// "profile/ab" matches "profile/abc.png". Pass the returned token to get
+	// the next page, an empty token means there are no more files.
+	List(prefix, token string, limit int) ([]FileInfo, string, error)
 }
 
+// ContextStorer is implemented by Storers that can tie their operations to a
+// context, e.g. to trace them as part of a request.
+type ContextStorer interface {
+	Storer
+	WithContext(ctx context.Context) Storer
+}
+
+// WithContext returns s bound to ctx if it supports it, otherwise s as is.
+func WithContext(ctx context.Context, s Storer) Storer {
+	if cs, ok := s.(ContextStorer); ok {
+		return cs.WithContext(ctx)
+	}
+	return s
+}
+
+// FileInfo describes a file returned by List.
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Used when List is called without a limit, matching the S3 maximum.
+const defaultListLimit = 1000
+
+/* OsStorer keeps files under Path on the local disk. Names come from callers
+ * and may ultimately come from users, so every operation goes through an
+ * os.Root which refuses to resolve anything outside Path, including through
+ * symlinks. Names that would escape are rejected with fs.ErrPermission. */
+
 type OsStorer struct {
 	Path string
 }
@@ -24,50 +71,254 @@ func (s OsStorer) Name() string {
 	return fmt.Sprintf("os: %s", s.Path)
 }
 
+// localName cleans a slash separated name and rejects absolute paths and
+// names that climb out of the root before we touch the disk.
+func localName(op, name string) (string, error) {
+	clean := path.Clean(filepath.ToSlash(name))
+	if !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return clean, nil
+}
+
+// rootErr maps errors os.Root makes up itself to fs.ErrPermission. Names were
+// checked by localName already, so what is left of those are escapes through
+// symlinks, which os.Root reports with an unexported error. Errors from the
+// operating system, such as a missing file or a full disk, are kept as is.
+func rootErr(op, name string, err error) error {
+	var errno syscall.Errno
+	if err == nil || errors.As(err, &errno) || errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, fs.ErrExist) || errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+}
+
+// openRoot opens the storage folder, creating it first for write operations.
+func (s OsStorer) openRoot(create bool) (*os.Root, error) {
+	if create {
+		if err := os.MkdirAll(s.Path, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenRoot(s.Path)
+}
+
 func (s OsStorer) Open(name string) (fs.File, error) {
-	fullPath := filepath.Join(s.Path, name)
-	return os.Open(fullPath)
+	clean, err := localName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.openRoot(false)
+	if err != nil {
+		return nil, err
+	}
+	// Files opened through the root stay valid after it is closed
+	defer root.Close()
+	f, err := root.Open(clean)
+	if err != nil {
+		return nil, rootErr("open", name, err)
+	}
+	return f, nil
 }
 
 func (s OsStorer) ReadFile(name string) ([]byte, error) {
-	fullPath := filepath.Join(s.Path, name)
-	return os.ReadFile(fullPath)
+	clean, err := localName("read", name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.openRoot(false)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	data, err := root.ReadFile(clean)
+	return data, rootErr("read", name, err)
 }
 
 func (s OsStorer) Create(name string) (io.WriteCloser, error) {
-	fullPath := filepath.Join(s.Path, name)
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	clean, err := localName("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if clean == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := s.openRoot(true)
+	if err != nil {
 		return nil, err
 	}
-	return os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	defer root.Close()
+	if err := root.MkdirAll(path.Dir(clean), 0755); err != nil {
+		return nil, rootErr("create", name, err)
+	}
+	f, err := root.OpenFile(clean, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, rootErr("create", name, err)
+	}
+	return f, nil
 }
 
 func (s OsStorer) WriteFile(name string, data []byte) error {
-	fullPath := filepath.Join(s.Path, name)
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	clean, err := localName("write", name)
+	if err != nil {
+		return err
+	}
+	if clean == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := s.openRoot(true)
+	if err != nil {
 		return err
 	}
-	return os.WriteFile(fullPath, data, 0644)
+	defer root.Close()
+	if err := root.MkdirAll(path.Dir(clean), 0755); err != nil {
+		return rootErr("write", name, err)
+	}
+	return rootErr("write", name, root.WriteFile(clean, data, 0644))
 }
 
 func (s OsStorer) Remove(name string) error {
-	fullPath := filepath.Join(s.Path, name)
-	if err := os.Remove(fullPath); err != nil {
+	clean, err := localName("remove", name)
+	if err != nil {
 		return err
 	}
-	// Optional cleanup, if it becomes a bottle neck just remove it.
-	dir := filepath.Dir(fullPath)
-	for dir != s.Path {
-		entries, err := os.ReadDir(dir)
-		if err != nil || len(entries) > 0 {
-			break
-		}
-		if err := os.Remove(dir); err != nil {
+	if clean == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := s.openRoot(false)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err := root.Remove(clean); err != nil {
+		return rootErr("remove", name, err)
+	}
+	removeEmptyParents(root, clean)
+	return nil
+}
+
+// removeEmptyParents removes the folders of name left empty. Optional, if it
+// becomes a bottle neck just remove it. Remove fails on non-empty folders which
+// ends the loop.
+func removeEmptyParents(root *os.Root, name string) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if err := root.Remove(dir); err != nil {
 			break
 		}
-		dir = filepath.Dir(dir)
 	}
+}
+
+func (s OsStorer) Rename(oldname, newname string) error {
+	oldClean, err := localName("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newClean, err := localName("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldClean == "." || newClean == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	root, err := s.openRoot(false)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if _, err := root.Stat(oldClean); err != nil {
+		return rootErr("rename", oldname, err)
+	}
+	if err := root.MkdirAll(path.Dir(newClean), 0755); err != nil {
+		return rootErr("rename", newname, err)
+	}
+	if err := root.Rename(oldClean, newClean); err != nil {
+		return rootErr("rename", oldname, err)
+	}
+	removeEmptyParents(root, oldClean)
 	return nil
 }
+
+func (s OsStorer) Stat(name string) (fs.FileInfo, error) {
+	clean, err := localName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.openRoot(false)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	info, err := root.Stat(clean)
+	return info, rootErr("stat", name, err)
+}
+
+func (s OsStorer) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not implemented")}
+	}
+	entries, err := dir.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, err
+}
+
+// List walks the folder containing prefix. The disk has no index to page
+// through so every call walks and sorts all the matches, the token is just
+// the last path returned.
+func (s OsStorer) List(prefix, token string, limit int) ([]FileInfo, string, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	dir := "."
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	if _, err := localName("list", dir); err != nil {
+		return nil, "", err
+	}
+	var files []FileInfo
+	err := fs.WalkDir(s, dir, func(name string, d fs.DirEntry, err error) error {
+		// A prefix nothing has been stored under yet is empty, not an error
+		if name == dir && errors.Is(err, fs.ErrNotExist) {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != dir && !strings.HasPrefix(name+"/", prefix) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(name, prefix) || name <= token {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Path: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// WalkDir visits a/b before a.txt because it sorts per folder
+	slices.SortFunc(files, func(a, b FileInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	if len(files) <= limit {
+		return files, "", nil
+	}
+	files = files[:limit]
+	return files, files[limit-1].Path, nil
+}
@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -62,3 +66,74 @@ func TestOsStorer_Delete(t *testing.T) {
 	err = s.Remove("nonexistent.txt")
 	require.Error(t, err)
 }
+
+func TestOsStorer_Escape(t *testing.T) {
+	parent := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0644))
+	s := OsStorer{Path: filepath.Join(parent, "root")}
+	require.NoError(t, s.WriteFile("inside.txt", []byte("inside")))
+	require.NoError(t, os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(s.Path, "link")))
+	require.NoError(t, os.Symlink(parent, filepath.Join(s.Path, "dirlink")))
+
+	names := []string{"../secret.txt", "a/../../secret.txt", filepath.Join(parent, "secret.txt"), "link", "dirlink/secret.txt"}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.ReadFile(name)
+			require.ErrorIs(t, err, fs.ErrPermission)
+			_, err = s.Open(name)
+			require.ErrorIs(t, err, fs.ErrPermission)
+			require.ErrorIs(t, s.WriteFile(name, []byte("x")), fs.ErrPermission)
+		})
+	}
+	require.ErrorIs(t, s.Remove("../secret.txt"), fs.ErrPermission)
+	_, err := os.Stat(filepath.Join(parent, "secret.txt"))
+	require.NoError(t, err)
+	// Ordinary errors are not mistaken for escapes
+	_, err = s.ReadFile("missing.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.NotErrorIs(t, err, fs.ErrPermission)
+}
+
+// FuzzOsStorer_Containment checks that no name can read, overwrite or delete
+// files outside the storage folder, whether through .., absolute paths or
+// symlinks planted inside the folder.
+func FuzzOsStorer_Containment(f *testing.F) {
+	for _, seed := range []string{
+		"inside.txt", "../secret.txt", "/etc/passwd", "a/../../secret.txt", "link", "dirlink/secret.txt",
+		"dirlink/../secret.txt", "./../secret.txt", "..", ".", "", "sub/../inside.txt", "dirlink",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		parent := t.TempDir()
+		secret := filepath.Join(parent, "secret.txt")
+		require.NoError(t, os.WriteFile(secret, []byte("top secret"), 0644))
+		s := OsStorer{Path: filepath.Join(parent, "root")}
+		require.NoError(t, s.WriteFile("inside.txt", []byte("inside")))
+		require.NoError(t, os.Symlink(secret, filepath.Join(s.Path, "link")))
+		require.NoError(t, os.Symlink(parent, filepath.Join(s.Path, "dirlink")))
+
+		if data, err := s.ReadFile(name); err == nil {
+			require.NotEqual(t, "top secret", string(data))
+		}
+		if file, err := s.Open(name); err == nil {
+			data, _ := io.ReadAll(file)
+			file.Close()
+			require.NotEqual(t, "top secret", string(data))
+		}
+		_ = s.WriteFile(name, []byte("overwritten"))
+		_ = s.Remove(name)
+		// The file outside the folder must be untouched and nothing new
+		// created next to it.
+		data, err := os.ReadFile(secret)
+		require.NoError(t, err)
+		require.Equal(t, "top secret", string(data))
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		require.ElementsMatch(t, []string{"root", "secret.txt"}, got)
+	})
+}
@@ -0,0 +1,286 @@
+// Package storagetest is a conformance suite for storage.Storer
+// implementations, every backend should pass it so callers can swap them
+// freely.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStorer runs the suite. newStorer must return a new, empty Storer for
+// every call.
+func TestStorer(t *testing.T, newStorer func(t *testing.T) storage.Storer) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storer)
+	}{
+		{"ReadWrite", testReadWrite},
+		{"Create", testCreate},
+		{"Open", testOpen},
+		{"NotExist", testNotExist},
+		{"InvalidNames", testInvalidNames},
+		{"Remove", testRemove},
+		{"Rename", testRename},
+		{"Listing", testListing},
+		{"Concurrent", testConcurrent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorer(t))
+		})
+	}
+}
+
+func testReadWrite(t *testing.T, s storage.Storer) {
+	data := []byte("hello world")
+	require.NoError(t, s.WriteFile("dir/sub dir/test.txt", data))
+	// Changing the slice afterwards must not change what was stored
+	data[0] = 'j'
+	got, err := s.ReadFile("dir/sub dir/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(got))
+
+	require.NoError(t, s.WriteFile("dir/sub dir/test.txt", []byte("overwritten")))
+	got, err = s.ReadFile("dir/sub dir/test.txt")
+	require.NoError(t, err)
+	require.Equal(t, "overwritten", string(got))
+
+	require.NoError(t, s.WriteFile("empty.txt", nil))
+	got, err = s.ReadFile("empty.txt")
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func testCreate(t *testing.T, s storage.Storer) {
+	w, err := s.Create("created/file.bin")
+	require.NoError(t, err)
+	var want []byte
+	for i := range 100 {
+		chunk := fmt.Appendf(nil, "chunk %d;", i)
+		want = append(want, chunk...)
+		n, err := w.Write(chunk)
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+	}
+	require.NoError(t, w.Close())
+	_, err = w.Write([]byte("late"))
+	require.Error(t, err)
+	got, err := s.ReadFile("created/file.bin")
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func testOpen(t *testing.T, s storage.Storer) {
+	require.NoError(t, s.WriteFile("a/open.txt", []byte("hello world")))
+	f, err := s.Open("a/open.txt")
+	require.NoError(t, err)
+	defer f.Close()
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, "open.txt", info.Name())
+	require.Equal(t, int64(11), info.Size())
+	require.False(t, info.IsDir())
+	require.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+
+	// Uploads are served with http.ServeContent which needs to seek
+	rs, ok := f.(io.ReadSeeker)
+	require.True(t, ok, "files should implement io.Seeker")
+	_, err = rs.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(rs)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(rest))
+}
+
+func testNotExist(t *testing.T, s storage.Storer) {
+	_, err := s.ReadFile("missing.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = s.Open("missing/file.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = s.Stat("missing.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = s.ReadDir("missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.ErrorIs(t, s.Remove("missing.txt"), fs.ErrNotExist)
+}
+
+// rejected reports whether err is one of the errors used for names that
+// can't be stored. Local backends refuse escapes with fs.ErrPermission while
+// remote ones reject them as fs.ErrInvalid.
+func rejected(err error) bool {
+	return errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrInvalid)
+}
+
+func testInvalidNames(t *testing.T, s storage.Storer) {
+	for _, name := range []string{"../escape.txt", "a/../../escape.txt", "/etc/passwd"} {
+		_, err := s.ReadFile(name)
+		require.True(t, rejected(err), "read %q: %v", name, err)
+		_, err = s.Open(name)
+		require.True(t, rejected(err), "open %q: %v", name, err)
+		err = s.WriteFile(name, []byte("x"))
+		require.True(t, rejected(err), "write %q: %v", name, err)
+		_, err = s.Create(name)
+		require.True(t, rejected(err), "create %q: %v", name, err)
+		err = s.Remove(name)
+		require.True(t, rejected(err), "remove %q: %v", name, err)
+		err = s.Rename(name, "renamed.txt")
+		require.True(t, rejected(err), "rename from %q: %v", name, err)
+		err = s.Rename("renamed.txt", name)
+		require.True(t, rejected(err), "rename to %q: %v", name, err)
+	}
+	require.Error(t, s.WriteFile(".", []byte("x")))
+	require.Error(t, s.Remove("."))
+}
+
+func testRemove(t *testing.T, s storage.Storer) {
+	require.NoError(t, s.WriteFile("a/b/c.txt", []byte("c")))
+	require.NoError(t, s.WriteFile("a/d.txt", []byte("d")))
+	require.NoError(t, s.Remove("a/b/c.txt"))
+	_, err := s.ReadFile("a/b/c.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Empty folders are cleaned up with their last file
+	_, err = s.Stat("a/b")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, []string{"d.txt"}, names(t, s, "a"))
+	require.NoError(t, s.Remove("a/d.txt"))
+	_, err = s.Stat("a")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Empty(t, names(t, s, "."))
+}
+
+func testRename(t *testing.T, s storage.Storer) {
+	require.NoError(t, s.WriteFile("tmp/part.txt", []byte("new")))
+	require.NoError(t, s.WriteFile("files/final.txt", []byte("old")))
+	require.NoError(t, s.Rename("tmp/part.txt", "files/final.txt"))
+	got, err := s.ReadFile("files/final.txt")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(got))
+	_, err = s.Stat("tmp/part.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	// Like Remove the emptied folder goes too
+	_, err = s.Stat("tmp")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// New folders are created as needed
+	require.NoError(t, s.Rename("files/final.txt", "a/b/moved.txt"))
+	got, err = s.ReadFile("a/b/moved.txt")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(got))
+
+	require.ErrorIs(t, s.Rename("missing.txt", "other.txt"), fs.ErrNotExist)
+	_, err = s.Stat("other.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func names(t *testing.T, s storage.Storer, dir string) []string {
+	entries, err := s.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func listAll(t *testing.T, s storage.Storer, prefix string, limit int) ([]string, int) {
+	var paths []string
+	pages := 0
+	token := ""
+	for {
+		list, next, err := s.List(prefix, token, limit)
+		require.NoError(t, err)
+		pages++
+		for _, f := range list {
+			paths = append(paths, f.Path)
+			require.Equal(t, int64(len(f.Path)), f.Size, f.Path)
+			require.WithinDuration(t, time.Now(), f.ModTime, time.Minute, f.Path)
+		}
+		if next == "" {
+			return paths, pages
+		}
+		require.Less(t, pages, 100, "listing does not end")
+		token = next
+	}
+}
+
+func testListing(t *testing.T, s storage.Storer) {
+	// Empty storage lists nothing rather than failing
+	paths, _ := listAll(t, s, "", 0)
+	require.Empty(t, paths)
+	require.Empty(t, names(t, s, "."))
+
+	files := []string{"a.txt", "a/b.txt", "a/c/d.txt", "profile/abc_512.png", "profile/abc_64.png", "profile/xyz_512.png"}
+	for _, f := range files {
+		require.NoError(t, s.WriteFile(f, []byte(f)))
+	}
+	info, err := s.Stat("a/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "b.txt", info.Name())
+	require.Equal(t, int64(len("a/b.txt")), info.Size())
+	require.False(t, info.IsDir())
+	info, err = s.Stat("a/c")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	entries, err := s.ReadDir(".")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "a.txt", "profile"}, names(t, s, "."))
+	require.True(t, entries[0].IsDir())
+	require.False(t, entries[1].IsDir())
+	require.Equal(t, []string{"b.txt", "c"}, names(t, s, "a"))
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(s, ".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			walked = append(walked, path)
+		}
+		return err
+	}))
+	require.ElementsMatch(t, files, walked)
+
+	// Lexical order puts a.txt before a/b.txt
+	paths, pages := listAll(t, s, "", 0)
+	require.Equal(t, files, paths)
+	require.Equal(t, 1, pages)
+	paths, _ = listAll(t, s, "profile/abc", 0)
+	require.Equal(t, []string{"profile/abc_512.png", "profile/abc_64.png"}, paths)
+	paths, _ = listAll(t, s, "nothing/", 0)
+	require.Empty(t, paths)
+
+	// Pages may come back short but never skip or repeat a file
+	paths, pages = listAll(t, s, "", 2)
+	require.Equal(t, files, paths)
+	require.GreaterOrEqual(t, pages, 3)
+}
+
+func testConcurrent(t *testing.T, s storage.Storer) {
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Go(func() {
+			name := fmt.Sprintf("concurrent/%02d.txt", i)
+			// require can't stop the test from another goroutine
+			assert.NoError(t, s.WriteFile(name, []byte(name)))
+			got, err := s.ReadFile(name)
+			assert.NoError(t, err)
+			assert.Equal(t, name, string(got))
+			_, _, err = s.List("concurrent/", "", 0)
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	paths, _ := listAll(t, s, "concurrent/", 0)
+	require.Len(t, paths, 20)
+	require.True(t, slices.IsSorted(paths))
+}
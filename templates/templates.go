@@ -1,46 +1,94 @@
 package templates
 
 import (
+	"bytes"
 	"embed"
+	"errors"
 	"html/template"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/nuric/go-web-app-template/utils"
 )
 
 /* When we embed, our binary effectively contains the templates. This allows us
- * to serve them without needing a separate file system. */
+ * to serve them without needing a separate file system.
+ *
+ * Plain text emails are parsed with text/template. html/template would escape
+ * their values for HTML, turning the & in a link into &amp; and breaking it. */
 
 //go:embed */*.html */*.txt
 var templatesFS embed.FS
 
 var tpl *template.Template
+var textTpl *texttemplate.Template
+
+// URLSigner is used by the signedURL template function. It receives a Storer
+// path, how long the URL should be valid for and an optional content
+// disposition. The application sets it during setup.
+var URLSigner func(name string, ttl time.Duration, disposition string) (string, error)
+
+var funcs = template.FuncMap{
+	// Usage: {{ signedURL .User.Picture "24h" }} or with a disposition
+	// {{ signedURL "reports/r.pdf" "1h" "attachment; filename=r.pdf" }}
+	"signedURL": func(name string, ttl string, disposition ...string) (string, error) {
+		if URLSigner == nil {
+			return "", errors.New("url signer not configured")
+		}
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return "", err
+		}
+		return URLSigner(name, d, strings.Join(disposition, ""))
+	},
+	// Usage: {{ formatBytes .StorageUsed }}
+	"formatBytes": utils.FormatBytes,
+}
 
 func init() {
 	// Parse all templates from the embedded filesystem
 	var err error
 	if tpl == nil {
-		tpl, err = template.ParseFS(templatesFS, "*/*.html", "*/*.txt")
+		tpl, err = template.New("").Funcs(funcs).ParseFS(templatesFS, "*/*.html")
 		if err != nil {
 			panic("could not parse templates: " + err.Error())
 		}
 	}
-	slog.Debug("Templates loaded", "template_count", len(tpl.Templates()))
+	if textTpl == nil {
+		textTpl, err = texttemplate.New("").Funcs(texttemplate.FuncMap(funcs)).ParseFS(templatesFS, "*/*.txt")
+		if err != nil {
+			panic("could not parse text templates: " + err.Error())
+		}
+	}
+	slog.Debug("Templates loaded", "template_count", len(tpl.Templates())+len(textTpl.Templates()))
+}
+
+// Render executes the named template into w.
+func Render(w io.Writer, name string, data any) error {
+	return tpl.ExecuteTemplate(w, name, data)
 }
 
 func RenderHTML(w http.ResponseWriter, name string, data any) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	// Render the template
-	if err := tpl.ExecuteTemplate(w, name, data); err != nil {
+	// Render into a buffer first so a failing template doesn't leave a half
+	// written page behind a 200
+	var buf bytes.Buffer
+	if err := Render(&buf, name, data); err != nil {
 		slog.Error("could not write template response", "error", err)
 		http.Error(w, "could not generate page", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
 }
 
 func RenderEmail(templateName string, data any) (string, error) {
 	// Render the template to a string
 	var body strings.Builder
-	if err := tpl.ExecuteTemplate(&body, templateName, data); err != nil {
+	if err := textTpl.ExecuteTemplate(&body, templateName, data); err != nil {
 		slog.Error("could not render email template", "error", err)
 		return "", err
 	}
@@ -0,0 +1,51 @@
+package templates
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderEmail_SignedURL(t *testing.T) {
+	signer := storage.URLSigner{Secret: []byte("secret"), Prefix: "/uploads/"}
+	URLSigner = func(name string, ttl time.Duration, disposition string) (string, error) {
+		u, err := signer.Sign(strings.TrimPrefix(name, signer.Prefix), time.Now().Add(ttl), disposition)
+		return "https://example.com" + u, err
+	}
+	t.Cleanup(func() { URLSigner = nil })
+	_, err := textTpl.New("test_signed_url.txt").Parse(`Download: {{ signedURL .Path "1h" "attachment; filename=r.pdf" }}`)
+	require.NoError(t, err)
+
+	body, err := RenderEmail("test_signed_url.txt", map[string]any{"Path": "/uploads/reports/r.pdf"})
+	require.NoError(t, err)
+	require.NotContains(t, body, "&amp;")
+	link, err := url.Parse(strings.TrimPrefix(body, "Download: "))
+	require.NoError(t, err)
+	require.Equal(t, "/uploads/reports/r.pdf", link.Path)
+	disposition, err := signer.Verify("reports/r.pdf", link.Query(), time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "attachment; filename=r.pdf", disposition)
+}
+
+func TestRenderEmail_NotEscaped(t *testing.T) {
+	body, err := RenderEmail("email_changed.txt", map[string]any{
+		"NewEmail":  "o'brien@example.com",
+		"UndoURL":   "https://example.com/undo-email-change?token=a+b&x=<y>",
+		"ExpiresAt": "2026-01-01 00:00 UTC",
+	})
+	require.NoError(t, err)
+	require.Contains(t, body, "https://example.com/undo-email-change?token=a+b&x=<y>\n")
+	require.Contains(t, body, "o'brien@example.com")
+}
+
+func TestRender_HTMLEscaped(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Render(&buf, "404.html", map[string]any{"Title": "<b>Gone</b>"}))
+	require.NotContains(t, buf.String(), "<b>Gone</b>")
+	require.Contains(t, buf.String(), "&lt;b&gt;Gone&lt;/b&gt;")
+}
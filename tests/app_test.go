@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/nuric/go-web-app-template/controllers"
+	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/utils"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+const testURLSecret = "32-character-long-url-secret-key"
+
+// Every test user has the same password
+const testPassword = "Password1!"
+
+// app is the whole application served over HTTP with a throw away database
+// and in-memory storage, tests reach into both to arrange and check state.
+type app struct {
+	*httptest.Server
+	DB     *gorm.DB
+	Storer storage.Storer
+}
+
+func newApp(t *testing.T, configure ...func(*controllers.Config)) app {
+	// Every connection to :memory: gets a database of its own, concurrent
+	// requests need a file they can share
+	dsn := "file:" + filepath.Join(t.TempDir(), "app.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{}, &models.Token{}, &models.KnownDevice{}, &models.Upload{},
+		&models.UploadShare{}, &models.ResumableUpload{}, &models.ResumableChunk{}, &models.AuditEvent{},
+	))
+	st := &storage.MemStorer{}
+	config := controllers.Config{
+		Database:    db,
+		Session:     sessions.NewCookieStore([]byte("32-character-long-secret-key-abc")),
+		Emailer:     email.LogEmailer{},
+		Storer:      st,
+		CSRFSecret:  "32-character-long-csrf-secret-key-xyz",
+		Debug:       true,
+		URLSecret:   testURLSecret,
+		UploadLimit: 1 << 20,
+	}
+	for _, c := range configure {
+		c(&config)
+	}
+	handler := controllers.Setup(config)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+	}))
+	t.Cleanup(ts.Close)
+	return app{Server: ts, DB: db, Storer: st}
+}
+
+// createUser adds a verified user with testPassword.
+func (a app) createUser(t *testing.T, address string) models.User {
+	user := models.User{Email: address, Password: utils.HashPassword(testPassword), EmailVerified: true}
+	require.NoError(t, a.DB.Create(&user).Error)
+	return user
+}
+
+// login returns a client with the session of the user.
+func (a app) login(t *testing.T, user models.User) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(a.URL + "/login")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	token := csrfField.FindSubmatch(body)
+	require.NotNil(t, token)
+	form := url.Values{
+		"gorilla.csrf.Token": {string(token[1])},
+		"_action":            {"login"},
+		"email":              {user.Email},
+		"password":           {testPassword},
+	}
+	resp, err = client.Post(a.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "/dashboard", resp.Request.URL.Path)
+	return client
+}
+
+// csrfToken returns a token for requests that don't come from a form, such as
+// those of tus clients.
+func (a app) csrfToken(t *testing.T, client *http.Client) string {
+	resp, err := client.Get(a.URL + "/account")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	token := csrfField.FindSubmatch(body)
+	require.NotNil(t, token)
+	return string(token[1])
+}
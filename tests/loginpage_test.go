@@ -22,7 +22,7 @@ func TestLoginPage(t *testing.T) {
 		Database:   db,
 		Session:    sessions.NewCookieStore([]byte("32-character-long-secret-key-abc")),
 		Emailer:    email.LogEmailer{},
-		Storer:     &storage.OsStorer{Path: t.TempDir()},
+		Storer:     &storage.MemStorer{},
 		CSRFSecret: "32-character-long-csrf-secret-key-xyz",
 		Debug:      true,
 	}
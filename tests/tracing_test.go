@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/nuric/go-web-app-template/controllers"
+	"github.com/nuric/go-web-app-template/email"
+	"github.com/nuric/go-web-app-template/middleware"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+)
+
+var csrfField = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+// children returns the names of the spans whose parent is parent, in the
+// order they ended which for sequential spans is the order they ran.
+func children(spans tracetest.SpanStubs, parent tracetest.SpanStub) []string {
+	var names []string
+	for _, s := range spans {
+		if s.Parent.SpanID() == parent.SpanContext.SpanID() {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+func find(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no span named %q", name)
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Token{}))
+	require.NoError(t, db.Use(tracing.GormPlugin{}))
+	config := controllers.Config{
+		Database:   db,
+		Session:    sessions.NewCookieStore([]byte("32-character-long-secret-key-abc")),
+		Emailer:    tracing.Emailer{Next: email.LogEmailer{}},
+		Storer:     tracing.Storer{Storer: &storage.MemStorer{}},
+		CSRFSecret: "32-character-long-csrf-secret-key-xyz",
+		Debug:      true,
+	}
+	handler := middleware.Trace(controllers.Setup(config))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+	}))
+	defer ts.Close()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+
+	// ---------------------------
+	resp, err := client.Get(ts.URL + "/login")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	spans := exp.GetSpans()
+	server := find(t, spans, "GET /login")
+	require.False(t, server.Parent.IsValid())
+	require.Equal(t, []string{"middleware.csrf"}, children(spans, server))
+	require.Equal(t, []string{"middleware.user"}, children(spans, find(t, spans, "middleware.csrf")))
+	require.Equal(t, []string{"page.PreHandle", "page.Handle", "page.PostHandle", "page.render"},
+		children(spans, find(t, spans, "middleware.user")))
+
+	// ---------------------------
+	exp.Reset()
+	token := csrfField.FindSubmatch(body)
+	require.NotNil(t, token)
+	form := url.Values{
+		"gorilla.csrf.Token": {string(token[1])},
+		"_action":            {"forgot_password"},
+		"resetEmail":         {"someone@example.com"},
+	}
+	resp, err = client.Post(ts.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	spans = exp.GetSpans()
+	// The client follows the redirect, the spans of the post end first
+	find(t, spans, "POST /login")
+	handle := find(t, spans, "page.Handle")
+	require.Equal(t, []string{"gorm.create", "email.send"}, children(spans, handle))
+	// The redirect means there is nothing to render
+	require.Equal(t, []string{"page.PreHandle", "page.Handle", "page.PostHandle"},
+		children(spans, find(t, spans, "middleware.user")))
+}
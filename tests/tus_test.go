@@ -0,0 +1,270 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuric/go-web-app-template/controllers"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/scan"
+	"github.com/stretchr/testify/require"
+)
+
+// tusClient sends tus requests with the session and CSRF token of a user.
+type tusClient struct {
+	t      *testing.T
+	a      app
+	client *http.Client
+	token  string
+}
+
+func newTusClient(t *testing.T, a app, user models.User) tusClient {
+	client := a.login(t, user)
+	return tusClient{t: t, a: a, client: client, token: a.csrfToken(t, client)}
+}
+
+func (c tusClient) do(method, path string, headers map[string]string, body string) *http.Response {
+	req, err := http.NewRequest(method, c.a.URL+path, strings.NewReader(body))
+	require.NoError(c.t, err)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("X-CSRF-Token", c.token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	require.NoError(c.t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func (c tusClient) create(size int) string {
+	resp := c.do(http.MethodPost, "/tus/", map[string]string{"Upload-Length": strconv.Itoa(size)}, "")
+	require.Equal(c.t, http.StatusCreated, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.True(c.t, strings.HasPrefix(location, "/tus/"), location)
+	return location
+}
+
+func (c tusClient) patch(location string, offset int, data string) *http.Response {
+	return c.do(http.MethodPatch, location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data)
+}
+
+func (c tusClient) offset(location string) int {
+	resp := c.do(http.MethodHead, location, nil, "")
+	require.Equal(c.t, http.StatusOK, resp.StatusCode)
+	offset, err := strconv.Atoi(resp.Header.Get("Upload-Offset"))
+	require.NoError(c.t, err)
+	return offset
+}
+
+func TestTus(t *testing.T) {
+	a := newApp(t)
+	alice := a.createUser(t, "alice@example.com")
+	c := newTusClient(t, a, alice)
+	data := "Hello, resumable world!"
+
+	location := c.create(len(data))
+	require.Equal(t, 0, c.offset(location))
+	resp := c.patch(location, 0, data[:5])
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("Upload-Offset"))
+	require.Equal(t, 5, c.offset(location))
+
+	// A client with a stale offset must ask for the current one
+	resp = c.patch(location, 0, data[:5])
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = c.patch(location, 10, data[10:])
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, 5, c.offset(location))
+
+	resp = c.patch(location, 5, data[5:])
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(len(data)), resp.Header.Get("Upload-Offset"))
+
+	var up models.ResumableUpload
+	require.NoError(t, a.DB.Where("uuid = ?", strings.TrimPrefix(location, "/tus/")).First(&up).Error)
+	require.NotZero(t, up.UploadID)
+	var upload models.Upload
+	require.NoError(t, a.DB.First(&upload, up.UploadID).Error)
+	require.Equal(t, alice.ID, upload.OwnerID)
+	stored, err := a.Storer.ReadFile(upload.Path)
+	require.NoError(t, err)
+	require.Equal(t, data, string(stored))
+	// Chunks are removed once joined
+	chunks, _, err := a.Storer.List("tus/", "", 0)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+	var count int64
+	require.NoError(t, a.DB.Model(&models.ResumableChunk{}).Count(&count).Error)
+	require.Zero(t, count)
+
+	// Nothing more to send once complete
+	resp = c.patch(location, len(data), "more")
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Retrying the last chunk after losing the response leaves the file be
+	resp = c.patch(location, len(data), "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(len(data)), resp.Header.Get("Upload-Offset"))
+	stored, err = a.Storer.ReadFile(upload.Path)
+	require.NoError(t, err)
+	require.Equal(t, data, string(stored))
+	require.NoError(t, a.DB.Model(&models.Upload{}).Count(&count).Error)
+	require.Equal(t, int64(1), count)
+}
+
+func TestTus_OtherUser(t *testing.T) {
+	a := newApp(t)
+	alice := newTusClient(t, a, a.createUser(t, "alice@example.com"))
+	bob := newTusClient(t, a, a.createUser(t, "bob@example.com"))
+	location := alice.create(10)
+	require.Equal(t, http.StatusNotFound, bob.do(http.MethodHead, location, nil, "").StatusCode)
+	require.Equal(t, http.StatusNotFound, bob.patch(location, 0, "0123456789").StatusCode)
+	require.Equal(t, http.StatusNotFound, bob.do(http.MethodDelete, location, nil, "").StatusCode)
+	require.Equal(t, 0, alice.offset(location))
+}
+
+func TestTus_Expiry(t *testing.T) {
+	a := newApp(t)
+	c := newTusClient(t, a, a.createUser(t, "alice@example.com"))
+	location := c.create(10)
+	require.Equal(t, http.StatusNoContent, c.patch(location, 0, "01234").StatusCode)
+	require.NoError(t, a.DB.Model(&models.ResumableUpload{}).Where("uuid = ?", strings.TrimPrefix(location, "/tus/")).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error)
+	require.Equal(t, http.StatusGone, c.do(http.MethodHead, location, nil, "").StatusCode)
+	require.Equal(t, http.StatusGone, c.patch(location, 5, "56789").StatusCode)
+}
+
+func TestTus_Terminate(t *testing.T) {
+	a := newApp(t)
+	c := newTusClient(t, a, a.createUser(t, "alice@example.com"))
+	location := c.create(10)
+	require.Equal(t, http.StatusNoContent, c.patch(location, 0, "01234").StatusCode)
+	require.Equal(t, http.StatusNoContent, c.do(http.MethodDelete, location, nil, "").StatusCode)
+	require.Equal(t, http.StatusNotFound, c.do(http.MethodHead, location, nil, "").StatusCode)
+	chunks, _, err := a.Storer.List("tus/", "", 0)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+}
+
+// Requests for the same offset may reach different replicas, only one of them
+// may store its chunk.
+func TestTus_ConcurrentPatch(t *testing.T) {
+	a := newApp(t)
+	c := newTusClient(t, a, a.createUser(t, "alice@example.com"))
+	const size = 64 << 10
+	location := c.create(size)
+	bodies := []string{strings.Repeat("a", size), strings.Repeat("b", size)}
+	statuses := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Go(func() {
+			statuses[i] = c.patch(location, 0, bodies[i%2]).StatusCode
+		})
+	}
+	wg.Wait()
+	won := 0
+	for _, s := range statuses {
+		require.Contains(t, []int{http.StatusNoContent, http.StatusConflict}, s)
+		if s == http.StatusNoContent {
+			won++
+		}
+	}
+	require.Equal(t, 1, won)
+	var up models.ResumableUpload
+	require.NoError(t, a.DB.Where("uuid = ?", strings.TrimPrefix(location, "/tus/")).First(&up).Error)
+	var upload models.Upload
+	require.NoError(t, a.DB.First(&upload, up.UploadID).Error)
+	stored, err := a.Storer.ReadFile(upload.Path)
+	require.NoError(t, err)
+	require.Len(t, stored, size)
+	require.Contains(t, bodies, string(stored))
+}
+
+func TestTus_Quota(t *testing.T) {
+	a := newApp(t, func(c *controllers.Config) {
+		c.StorageQuotas = map[string]int64{"basic": 100}
+	})
+	c := newTusClient(t, a, a.createUser(t, "alice@example.com"))
+	c.create(60)
+	// The first upload is reserved in full even though nothing arrived yet
+	resp := c.do(http.MethodPost, "/tus/", map[string]string{"Upload-Length": "60"}, "")
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	c.create(40)
+}
+
+// limitedScanner refuses content larger than limit like clamd does.
+type limitedScanner struct {
+	limit int64
+}
+
+func (s limitedScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	if n > s.limit {
+		return scan.Result{}, scan.ErrTooLarge
+	}
+	return scan.Result{}, nil
+}
+
+// Uploads larger than the scanner accepts are rejected unless storing them
+// unscanned is allowed, which is recorded in the audit log.
+func TestTus_TooLargeToScan(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowUnscanned bool
+		want           int
+		wantUploads    int64
+		wantEvents     []string
+	}{
+		{"Rejected", false, http.StatusRequestEntityTooLarge, 1, nil},
+		{"AllowUnscanned", true, http.StatusNoContent, 2, []string{models.AuditUploadNotScanned}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newApp(t, func(c *controllers.Config) {
+				c.Scanner = limitedScanner{limit: 10}
+				c.AllowUnscanned = tt.allowUnscanned
+			})
+			alice := a.createUser(t, "alice@example.com")
+			c := newTusClient(t, a, alice)
+			location := c.create(5)
+			require.Equal(t, http.StatusNoContent, c.patch(location, 0, "small").StatusCode)
+
+			data := "larger than ten bytes"
+			location = c.create(len(data))
+			require.Equal(t, tt.want, c.patch(location, 0, data).StatusCode)
+			var uploads int64
+			require.NoError(t, a.DB.Model(&models.Upload{}).Count(&uploads).Error)
+			require.Equal(t, tt.wantUploads, uploads)
+			var events []models.AuditEvent
+			require.NoError(t, a.DB.Find(&events).Error)
+			var actions []string
+			for _, e := range events {
+				require.Equal(t, alice.ID, e.UserID)
+				actions = append(actions, e.Action)
+			}
+			require.Equal(t, tt.wantEvents, actions)
+			if !tt.allowUnscanned {
+				// Rejected uploads are deleted rather than left to retry
+				resp := c.do(http.MethodHead, location, nil, "")
+				require.Equal(t, http.StatusNotFound, resp.StatusCode)
+				chunks, _, err := a.Storer.List("tus/", "", 0)
+				require.NoError(t, err)
+				require.Empty(t, chunks)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/uploads"
+	"github.com/stretchr/testify/require"
+)
+
+// A 1x1 PNG
+var pngData = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestUploadsHandler(t *testing.T) {
+	a := newApp(t)
+	alice := a.createUser(t, "alice@example.com")
+	bob := a.createUser(t, "bob@example.com")
+	carol := a.createUser(t, "carol@example.com")
+	files := []models.Upload{
+		{Path: "docs/private.txt", OwnerID: alice.ID, Visibility: models.VisibilityPrivate},
+		{Path: "docs/shared.txt", OwnerID: alice.ID, Visibility: models.VisibilityShared},
+		{Path: "docs/public.txt", OwnerID: alice.ID, Visibility: models.VisibilityPublic},
+	}
+	for i := range files {
+		files[i].ContentType = "text/plain"
+		require.NoError(t, a.DB.Create(&files[i]).Error)
+		require.NoError(t, a.Storer.WriteFile(files[i].Path, []byte(files[i].Path)))
+	}
+	require.NoError(t, a.DB.Create(&models.UploadShare{UploadID: files[1].ID, UserID: bob.ID}).Error)
+	// Stored but never recorded
+	require.NoError(t, a.Storer.WriteFile("docs/untracked.txt", []byte("untracked")))
+
+	clients := map[string]*http.Client{
+		"alice": a.login(t, alice),
+		"bob":   a.login(t, bob),
+		"carol": a.login(t, carol),
+		"guest": {},
+	}
+	tests := []struct {
+		path   string
+		client string
+		status int
+	}{
+		{"docs/private.txt", "alice", http.StatusOK},
+		{"docs/private.txt", "bob", http.StatusNotFound},
+		{"docs/private.txt", "guest", http.StatusNotFound},
+		{"docs/shared.txt", "alice", http.StatusOK},
+		{"docs/shared.txt", "bob", http.StatusOK},
+		{"docs/shared.txt", "carol", http.StatusNotFound},
+		{"docs/public.txt", "guest", http.StatusOK},
+		{"docs/untracked.txt", "alice", http.StatusNotFound},
+		{"docs/untracked.txt", "guest", http.StatusNotFound},
+		{"docs/missing.txt", "alice", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+"/"+tt.client, func(t *testing.T) {
+			status, body := get(t, clients[tt.client], a.URL+"/uploads/"+tt.path)
+			require.Equal(t, tt.status, status)
+			if status == http.StatusOK {
+				require.Equal(t, tt.path, body)
+			}
+		})
+	}
+}
+
+func TestUploadsHandler_SignedURL(t *testing.T) {
+	a := newApp(t)
+	alice := a.createUser(t, "alice@example.com")
+	upload := models.Upload{Path: "docs/private.txt", OwnerID: alice.ID, Visibility: models.VisibilityPrivate, ContentType: "text/plain"}
+	require.NoError(t, a.DB.Create(&upload).Error)
+	require.NoError(t, a.Storer.WriteFile(upload.Path, []byte("private")))
+	signer := storage.URLSigner{Secret: []byte(testURLSecret), Prefix: "/uploads/"}
+
+	link, err := signer.Sign(upload.Path, time.Now().Add(time.Hour), "")
+	require.NoError(t, err)
+	status, body := get(t, http.DefaultClient, a.URL+link)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "private", body)
+
+	// The signature covers the path
+	other, err := signer.Sign("docs/other.txt", time.Now().Add(time.Hour), "")
+	require.NoError(t, err)
+	_, query, _ := strings.Cut(other, "?")
+	status, _ = get(t, http.DefaultClient, a.URL+"/uploads/"+upload.Path+"?"+query)
+	require.Equal(t, http.StatusForbidden, status)
+
+	expired, err := signer.Sign(upload.Path, time.Now().Add(-time.Minute), "")
+	require.NoError(t, err)
+	status, _ = get(t, http.DefaultClient, a.URL+expired)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+// Pictures from before uploads were recorded have no row until backfilled.
+func TestUploadsHandler_BackfilledPicture(t *testing.T) {
+	a := newApp(t)
+	alice := a.createUser(t, "alice@example.com")
+	bob := a.createUser(t, "bob@example.com")
+	require.NoError(t, a.Storer.WriteFile("profile/legacy.png", pngData))
+	require.NoError(t, a.Storer.WriteFile("profile/legacy.html", []byte("<html><script>alert(1)</script></html>")))
+	require.NoError(t, a.DB.Model(&alice).Update("picture", "/uploads/profile/legacy.png").Error)
+	require.NoError(t, a.DB.Model(&bob).Update("picture", "/uploads/profile/legacy.html").Error)
+	aliceClient := a.login(t, alice)
+
+	status, _ := get(t, aliceClient, a.URL+"/uploads/profile/legacy.png")
+	require.Equal(t, http.StatusNotFound, status)
+
+	n, err := uploads.BackfillPictures(context.Background(), a.DB, a.Storer)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	resp, err := aliceClient.Get(a.URL + "/uploads/profile/legacy.png")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	status, _ = get(t, http.DefaultClient, a.URL+"/uploads/profile/legacy.png")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// Only images keep their type, anything else is a download
+	var html models.Upload
+	require.NoError(t, a.DB.Where("path = ?", "profile/legacy.html").First(&html).Error)
+	require.Equal(t, "application/octet-stream", html.ContentType)
+	require.Equal(t, bob.ID, html.OwnerID)
+
+	// Running it again changes nothing
+	n, err = uploads.BackfillPictures(context.Background(), a.DB, a.Storer)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
@@ -0,0 +1,24 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/nuric/go-web-app-template/email"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Emailer traces sends through Next. Addresses are left out of the span since
+// traces are not the place for personal data.
+type Emailer struct {
+	Next email.Emailer
+}
+
+func (e Emailer) SendEmail(ctx context.Context, to string, subject string, body string) error {
+	ctx, span := Tracer().Start(ctx, "email.send", trace.WithAttributes(
+		attribute.String("email.subject", subject),
+	))
+	err := e.Next.SendEmail(ctx, to, subject, body)
+	End(span, err)
+	return err
+}
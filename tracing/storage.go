@@ -0,0 +1,134 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"io/fs"
+
+	"github.com/nuric/go-web-app-template/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Storer traces the operations of the Storer it wraps. Bind it to a request
+// with storage.WithContext, operations start a trace of their own otherwise.
+// Files written through Create are traced until they are closed.
+type Storer struct {
+	storage.Storer
+	ctx context.Context
+}
+
+func (s Storer) WithContext(ctx context.Context) storage.Storer {
+	s.ctx = ctx
+	return s
+}
+
+func (s Storer) start(op, name string) trace.Span {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := Tracer().Start(ctx, "storage."+op, trace.WithAttributes(
+		attribute.String("storage.name", s.Storer.Name()),
+		attribute.String("storage.path", name),
+	))
+	return span
+}
+
+func (s Storer) Open(name string) (fs.File, error) {
+	span := s.start("Open", name)
+	f, err := s.Storer.Open(name)
+	End(span, err)
+	return f, err
+}
+
+func (s Storer) ReadFile(name string) ([]byte, error) {
+	span := s.start("ReadFile", name)
+	data, err := s.Storer.ReadFile(name)
+	span.SetAttributes(attribute.Int("storage.size", len(data)))
+	End(span, err)
+	return data, err
+}
+
+func (s Storer) ReadDir(name string) ([]fs.DirEntry, error) {
+	span := s.start("ReadDir", name)
+	entries, err := s.Storer.ReadDir(name)
+	End(span, err)
+	return entries, err
+}
+
+func (s Storer) Stat(name string) (fs.FileInfo, error) {
+	span := s.start("Stat", name)
+	info, err := s.Storer.Stat(name)
+	End(span, err)
+	return info, err
+}
+
+func (s Storer) Create(name string) (io.WriteCloser, error) {
+	span := s.start("Create", name)
+	wc, err := s.Storer.Create(name)
+	if err != nil {
+		End(span, err)
+		return nil, err
+	}
+	return &tracedWriter{WriteCloser: wc, span: span}, nil
+}
+
+func (s Storer) WriteFile(name string, data []byte) error {
+	span := s.start("WriteFile", name)
+	span.SetAttributes(attribute.Int("storage.size", len(data)))
+	err := s.Storer.WriteFile(name, data)
+	End(span, err)
+	return err
+}
+
+func (s Storer) Remove(name string) error {
+	span := s.start("Remove", name)
+	err := s.Storer.Remove(name)
+	End(span, err)
+	return err
+}
+
+func (s Storer) Rename(oldname, newname string) error {
+	span := s.start("Rename", oldname)
+	span.SetAttributes(attribute.String("storage.new_path", newname))
+	err := s.Storer.Rename(oldname, newname)
+	End(span, err)
+	return err
+}
+
+func (s Storer) List(prefix, token string, limit int) ([]storage.FileInfo, string, error) {
+	span := s.start("List", prefix)
+	files, next, err := s.Storer.List(prefix, token, limit)
+	span.SetAttributes(attribute.Int("storage.files", len(files)))
+	End(span, err)
+	return files, next, err
+}
+
+// tracedWriter ends the span of Create once the file is closed, which is
+// when remote storers commit it.
+type tracedWriter struct {
+	io.WriteCloser
+	span    trace.Span
+	written int64
+	err     error
+}
+
+func (w *tracedWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *tracedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.span.SetAttributes(attribute.Int64("storage.size", w.written))
+	if err == nil {
+		err = w.err
+	}
+	End(w.span, err)
+	return err
+}
@@ -0,0 +1,82 @@
+// Package tracing sets up OpenTelemetry and instruments what the standard
+// library and our dependencies don't: GORM queries, Storer operations and
+// email sends. HTTP spans are started by middleware.Trace and pages add a span
+// for each of their phases.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name identifies our instrumentation.
+const Name = "github.com/nuric/go-web-app-template"
+
+// Tracer returns our tracer from the global provider. It is looked up on
+// every call so tests can swap the provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/* Without an exporter no provider is installed and spans cost next to nothing,
+ * but trace context is still propagated so a caller's trace isn't broken by
+ * passing through us. The standard OTEL_* environment variables apply, e.g.
+ * OTEL_EXPORTER_OTLP_ENDPOINT for where spans are sent, OTEL_SERVICE_NAME and
+ * OTEL_TRACES_SAMPLER to keep a fraction of traces. */
+
+// Setup installs the global tracer provider with the given exporter: "otlp"
+// sends spans to a collector over HTTP, "stdout" prints them for local
+// debugging and "" disables tracing. The returned function flushes pending
+// spans and must be called before exiting.
+func Setup(ctx context.Context, exporter, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s exporter: %w", exporter, err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		// The environment overrides the service name above
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("could not create resource: %w", err), exp.Shutdown(ctx))
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
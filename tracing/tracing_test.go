@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/nuric/go-web-app-template/storage/storagetest"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+)
+
+// recordSpans installs a provider that keeps finished spans in memory.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		tp.Shutdown(context.Background())
+	})
+	return exp
+}
+
+func attr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+type item struct {
+	ID   uint
+	Name string
+}
+
+func TestGormPlugin(t *testing.T) {
+	exp := recordSpans(t)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Use(GormPlugin{}))
+	require.NoError(t, db.AutoMigrate(&item{}))
+	exp.Reset()
+
+	ctx, parent := Tracer().Start(context.Background(), "request")
+	require.NoError(t, db.WithContext(ctx).Create(&item{Name: "secret"}).Error)
+	require.ErrorIs(t, db.WithContext(ctx).First(&item{}, 42).Error, gorm.ErrRecordNotFound)
+	require.Error(t, db.WithContext(ctx).Exec("SELECT * FROM missing").Error)
+	parent.End()
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 4)
+	tests := []struct {
+		name   string
+		table  string
+		status codes.Code
+	}{
+		{"gorm.create", "items", codes.Unset},
+		{"gorm.query", "items", codes.Unset},
+		{"gorm.raw", "", codes.Error},
+	}
+	for i, tt := range tests {
+		s := spans[i]
+		require.Equal(t, tt.name, s.Name)
+		require.Equal(t, parent.SpanContext().SpanID(), s.Parent.SpanID(), tt.name)
+		require.Equal(t, tt.table, attr(s, "db.collection.name").AsString(), tt.name)
+		require.Equal(t, "sqlite", attr(s, "db.system.name").AsString())
+		require.Equal(t, tt.status, s.Status.Code, tt.name)
+		require.NotContains(t, attr(s, "db.query.text").AsString(), "secret")
+	}
+	require.Contains(t, attr(spans[0], "db.query.text").AsString(), "INSERT INTO `items`")
+	require.Equal(t, int64(1), attr(spans[0], "db.rows_affected").AsInt64())
+}
+
+func TestStorer(t *testing.T) {
+	recordSpans(t)
+	storagetest.TestStorer(t, func(t *testing.T) storage.Storer {
+		return Storer{Storer: &storage.MemStorer{}}
+	})
+}
+
+func TestStorer_Spans(t *testing.T) {
+	exp := recordSpans(t)
+	ctx, parent := Tracer().Start(context.Background(), "request")
+	s := storage.WithContext(ctx, Storer{Storer: &storage.MemStorer{}})
+	wc, err := s.Create("files/a")
+	require.NoError(t, err)
+	_, err = io.WriteString(wc, "hello")
+	require.NoError(t, err)
+	// The span of Create lasts until the file is closed
+	require.Empty(t, exp.GetSpans())
+	require.NoError(t, wc.Close())
+	_, err = s.ReadFile("files/missing")
+	require.Error(t, err)
+	parent.End()
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 3)
+	require.Equal(t, "storage.Create", spans[0].Name)
+	require.Equal(t, "files/a", attr(spans[0], "storage.path").AsString())
+	require.Equal(t, int64(5), attr(spans[0], "storage.size").AsInt64())
+	require.Equal(t, "storage.ReadFile", spans[1].Name)
+	require.Equal(t, codes.Error, spans[1].Status.Code)
+	for _, span := range spans[:2] {
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	}
+}
+
+type fakeEmailer struct {
+	err error
+}
+
+func (e fakeEmailer) SendEmail(ctx context.Context, to, subject, body string) error {
+	// Whatever the emailer does is part of the send
+	_, span := Tracer().Start(ctx, "smtp")
+	span.End()
+	return e.err
+}
+
+func TestEmailer(t *testing.T) {
+	exp := recordSpans(t)
+	require.NoError(t, Emailer{Next: fakeEmailer{}}.SendEmail(context.Background(), "a@example.com", "Hello", "body"))
+	require.Error(t, Emailer{Next: fakeEmailer{errors.New("refused")}}.SendEmail(context.Background(), "a@example.com", "Hello", "body"))
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 4)
+	require.Equal(t, "smtp", spans[0].Name)
+	require.Equal(t, "email.send", spans[1].Name)
+	require.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+	require.Equal(t, "Hello", attr(spans[1], "email.subject").AsString())
+	require.Equal(t, codes.Unset, spans[1].Status.Code)
+	require.Equal(t, codes.Error, spans[3].Status.Code)
+	for _, span := range spans {
+		for _, kv := range span.Attributes {
+			require.NotContains(t, kv.Value.Emit(), "a@example.com")
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	tests := []struct {
+		exporter string
+		wantErr  bool
+	}{
+		{"", false},
+		{"stdout", false},
+		{"otlp", false},
+		{"zipkin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.exporter, func(t *testing.T) {
+			shutdown, err := Setup(context.Background(), tt.exporter, "test")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, shutdown(context.Background()))
+		})
+	}
+}
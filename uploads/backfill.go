@@ -0,0 +1,91 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/* Profile pictures stored before uploads were recorded have no Upload row, so
+ * /uploads refuses to serve them and the garbage collector would take them for
+ * orphans. BackfillPictures records them as private uploads of their users.
+ * It only touches pictures without a row, so it is safe to run on every start
+ * and from several replicas at once.
+ *
+ * Back then any file was accepted as a picture under the name the browser
+ * gave it, so we sniff the content type instead of trusting the extension. A
+ * file that doesn't look like an image is served as a download. */
+
+// BackfillPictures creates Upload rows for the current pictures of users that
+// have none and returns how many it created.
+func BackfillPictures(ctx context.Context, db *gorm.DB, st storage.Storer) (int, error) {
+	var users []models.User
+	if err := db.WithContext(ctx).Select("id", "picture").Where("picture LIKE ?", "/uploads/profile/%").Find(&users).Error; err != nil {
+		return 0, fmt.Errorf("load users: %w", err)
+	}
+	created := 0
+	for _, u := range users {
+		path := strings.TrimPrefix(u.Picture, "/uploads/")
+		var count int64
+		if err := db.WithContext(ctx).Unscoped().Model(&models.Upload{}).Where("path = ?", path).Count(&count).Error; err != nil {
+			return created, fmt.Errorf("find upload: %w", err)
+		}
+		if count > 0 {
+			continue
+		}
+		contentType, size, err := sniff(st, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing to serve, the picture is already broken
+			continue
+		}
+		if err != nil {
+			return created, fmt.Errorf("read %s: %w", path, err)
+		}
+		upload := models.Upload{
+			Path:        path,
+			OwnerID:     u.ID,
+			Visibility:  models.VisibilityPrivate,
+			ContentType: contentType,
+			Size:        size,
+		}
+		result := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&upload)
+		if result.Error != nil {
+			return created, fmt.Errorf("create upload: %w", result.Error)
+		}
+		created += int(result.RowsAffected)
+	}
+	return created, nil
+}
+
+// sniff returns the content type and size of a stored file, only images keep
+// their detected type.
+func sniff(st storage.Storer, path string) (string, int64, error) {
+	f, err := st.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", 0, err
+	}
+	info, err := st.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = "application/octet-stream"
+	}
+	return contentType, info.Size(), nil
+}
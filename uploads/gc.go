@@ -0,0 +1,254 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"gorm.io/gorm"
+)
+
+/* Files in the Storer are written before or alongside their database rows and
+ * are never removed when they are replaced, e.g. every profile update stores a
+ * new picture. The garbage collector reconciles the two: it lists the Storer
+ * and removes files nothing refers to anymore. A file is referenced when
+ *
+ *  - it is a user's current Picture, with or without an Upload row, as
+ *    pictures stored before uploads were recorded have none,
+ *  - it belongs to the upload group of a user's current Picture, or
+ *  - it has an Upload row, is not a profile picture and its owner exists.
+ *
+ * Chunks of resumable uploads under tus/<uuid>/ are referenced while their
+ * upload is incomplete and has not expired. Expired resumable uploads are
+ * deleted along with their chunks. Files under quarantine/ are flagged uploads
+ * kept for review, they are left for an administrator to remove.
+ *
+ * Anything else, including files left behind by a failed transaction which
+ * have no Upload row at all, is an orphan. Orphans younger than the grace
+ * period are left alone because their transaction may still be running. */
+
+// GC removes orphaned files from a Storer.
+type GC struct {
+	DB     *gorm.DB
+	Storer storage.Storer
+	// Only orphans last modified longer than this ago are removed
+	GracePeriod time.Duration
+	// Report what would be removed without removing anything
+	DryRun bool
+	Now    func() time.Time
+}
+
+// Orphan is a file that nothing references.
+type Orphan struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Reason  string
+}
+
+// Report summarises a collection run. In a dry run Orphans lists what would
+// have been removed.
+type Report struct {
+	DryRun  bool
+	Scanned int
+	Orphans []Orphan
+	Bytes   int64
+	// Resumable uploads past their expiry
+	Expired int
+	// Orphans that could not be removed, the run carries on past them
+	Errors []error
+}
+
+// groupKey is what ties the sizes of the same picture together. Uploads from
+// before groups existed are their own group.
+func groupKey(u models.Upload) string {
+	if u.Group != "" {
+		return u.Group
+	}
+	return u.Path
+}
+
+// orphanReasons returns why each Upload row is no longer referenced, rows
+// that are referenced are not in the map, and the paths of current pictures.
+// We load the tables whole, which is fine for the number of uploads this
+// template expects.
+func (g GC) orphanReasons(uploads map[string]models.Upload) (map[string]string, map[string]bool, error) {
+	var users []models.User
+	if err := g.DB.Select("id", "picture").Find(&users).Error; err != nil {
+		return nil, nil, fmt.Errorf("load users: %w", err)
+	}
+	owners := make(map[uint]bool, len(users))
+	pictures := make(map[string]bool)
+	pictureGroups := make(map[string]bool)
+	for _, u := range users {
+		owners[u.ID] = true
+		if u.Picture == "" {
+			continue
+		}
+		picture := strings.TrimPrefix(u.Picture, "/uploads/")
+		pictures[picture] = true
+		if up, ok := uploads[picture]; ok {
+			pictureGroups[groupKey(up)] = true
+		}
+	}
+	reasons := make(map[string]string)
+	for path, up := range uploads {
+		switch {
+		case !owners[up.OwnerID]:
+			reasons[path] = "owner deleted"
+		case strings.HasPrefix(path, "profile/") && !pictureGroups[groupKey(up)]:
+			reasons[path] = "picture replaced"
+		}
+	}
+	return reasons, pictures, nil
+}
+
+// Run lists the Storer once and removes, or reports, orphaned files.
+func (g GC) Run(ctx context.Context) (Report, error) {
+	report := Report{DryRun: g.DryRun}
+	now := time.Now
+	if g.Now != nil {
+		now = g.Now
+	}
+	cutoff := now().Add(-g.GracePeriod)
+	var rows []models.Upload
+	if err := g.DB.Find(&rows).Error; err != nil {
+		return report, fmt.Errorf("load uploads: %w", err)
+	}
+	uploads := make(map[string]models.Upload, len(rows))
+	for _, up := range rows {
+		uploads[up.Path] = up
+	}
+	reasons, pictures, err := g.orphanReasons(uploads)
+	if err != nil {
+		return report, err
+	}
+	var resumable []models.ResumableUpload
+	if err := g.DB.Find(&resumable).Error; err != nil {
+		return report, fmt.Errorf("load resumable uploads: %w", err)
+	}
+	receiving := make(map[string]bool)
+	var expired []uint
+	for _, up := range resumable {
+		if now().After(up.ExpiresAt) {
+			expired = append(expired, up.ID)
+			report.Expired++
+		} else if up.UploadID == 0 {
+			receiving[up.UUID] = true
+		}
+	}
+	// Removing files while listing could shift the pages so we collect first
+	token := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files, next, err := g.Storer.List("", token, 0)
+		if err != nil {
+			return report, fmt.Errorf("list storage: %w", err)
+		}
+		for _, f := range files {
+			report.Scanned++
+			if strings.HasPrefix(f.Path, "quarantine/") || pictures[f.Path] {
+				continue
+			}
+			reason, ok := reasons[f.Path]
+			if _, tracked := uploads[f.Path]; !tracked {
+				reason, ok = "no upload record", true
+			}
+			if rest, isChunk := strings.CutPrefix(f.Path, "tus/"); isChunk {
+				id, _, _ := strings.Cut(rest, "/")
+				if receiving[id] {
+					continue
+				}
+				reason = "resumable upload expired or complete"
+			}
+			if !ok || f.ModTime.After(cutoff) {
+				continue
+			}
+			report.Orphans = append(report.Orphans, Orphan{Path: f.Path, Size: f.Size, ModTime: f.ModTime, Reason: reason})
+			report.Bytes += f.Size
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if g.DryRun {
+		return report, nil
+	}
+	if len(expired) > 0 {
+		err := g.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("resumable_upload_id IN ?", expired).Delete(&models.ResumableChunk{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&models.ResumableUpload{}, expired).Error
+		})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("delete expired resumable uploads: %w", err))
+		}
+	}
+	for _, o := range report.Orphans {
+		if err := g.remove(o.Path, uploads); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+	return report, nil
+}
+
+func (g GC) remove(path string, uploads map[string]models.Upload) error {
+	if err := g.Storer.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	up, ok := uploads[path]
+	if !ok {
+		return nil
+	}
+	// Unscoped so the unique path can be used again
+	return g.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("upload_id = ?", up.ID).Delete(&models.UploadShare{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&up).Error
+	})
+}
+
+// Start runs the collector every interval until the context is cancelled,
+// logging a report of each run. The first run is an interval after starting
+// so a deploy that breaks references has time to be noticed before anything
+// is removed.
+func (g GC) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := g.Run(ctx)
+		if err != nil {
+			slog.Error("could not collect orphaned uploads", "error", err)
+		}
+		report.Log()
+	}
+}
+
+// Log writes the report, listing every orphan in a dry run.
+func (r Report) Log() {
+	if r.DryRun {
+		for _, o := range r.Orphans {
+			slog.Info("Orphaned upload", "path", o.Path, "size", o.Size, "modTime", o.ModTime, "reason", o.Reason)
+		}
+	}
+	for _, err := range r.Errors {
+		slog.Error("could not remove orphaned upload", "error", err)
+	}
+	slog.Info("Upload garbage collection", "dryRun", r.DryRun, "scanned", r.Scanned, "orphans", len(r.Orphans), "bytes", r.Bytes, "expired", r.Expired)
+}
@@ -0,0 +1,146 @@
+package uploads
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/nuric/go-web-app-template/models"
+	"github.com/nuric/go-web-app-template/storage"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestGC(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Upload{}, &models.UploadShare{}, &models.ResumableUpload{}, &models.ResumableChunk{}))
+	dir := t.TempDir()
+	st := storage.OsStorer{Path: dir}
+
+	alice := models.User{Email: "alice@example.com", Password: "x", Picture: "/uploads/profile/new_512.png"}
+	bob := models.User{Email: "bob@example.com", Password: "x"}
+	// Pictures stored before uploads were recorded have no row
+	carol := models.User{Email: "carol@example.com", Password: "x", Picture: "/uploads/profile/legacy.png"}
+	require.NoError(t, db.Create(&alice).Error)
+	require.NoError(t, db.Create(&bob).Error)
+	require.NoError(t, db.Create(&carol).Error)
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		path    string
+		owner   uint
+		group   string
+		tracked bool
+		modTime time.Time
+	}{
+		{"profile/new_512.png", alice.ID, "new", true, old},
+		{"profile/new_64.png", alice.ID, "new", true, old},
+		{"profile/old_512.png", alice.ID, "old", true, old},
+		{"profile/old_64.png", alice.ID, "old", true, old},
+		{"docs/report.pdf", alice.ID, "", true, old},
+		{"docs/bob.pdf", bob.ID, "", true, old},
+		{"profile/half_written.png", 0, "", false, old},
+		{"profile/in_progress.png", 0, "", false, time.Now()},
+		{"tus/receiving/00000000000000000000", 0, "", false, old},
+		{"tus/expired/00000000000000000000", 0, "", false, old},
+		{"quarantine/flagged", 0, "", false, old},
+		{"profile/legacy.png", 0, "", false, old},
+	}
+	resumable := []models.ResumableUpload{
+		{UUID: "receiving", OwnerID: alice.ID, Size: 10, ExpiresAt: time.Now().Add(time.Hour)},
+		{UUID: "expired", OwnerID: alice.ID, Size: 10, ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	require.NoError(t, db.Create(&resumable).Error)
+	for _, f := range files {
+		require.NoError(t, st.WriteFile(f.path, []byte(f.path)))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, f.path), f.modTime, f.modTime))
+		if f.tracked {
+			up := models.Upload{Path: f.path, OwnerID: f.owner, Group: f.group, ContentType: "text/plain"}
+			require.NoError(t, db.Create(&up).Error)
+		}
+	}
+	require.NoError(t, db.Delete(&bob).Error)
+
+	gc := GC{DB: db, Storer: st, GracePeriod: 24 * time.Hour, DryRun: true}
+	report, err := gc.Run(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(files), report.Scanned)
+	reasons := make(map[string]string)
+	for _, o := range report.Orphans {
+		reasons[o.Path] = o.Reason
+	}
+	want := map[string]string{
+		"profile/old_512.png":              "picture replaced",
+		"profile/old_64.png":               "picture replaced",
+		"docs/bob.pdf":                     "owner deleted",
+		"profile/half_written.png":         "no upload record",
+		"tus/expired/00000000000000000000": "resumable upload expired or complete",
+	}
+	require.Equal(t, want, reasons)
+	require.Equal(t, 1, report.Expired)
+	// A dry run leaves everything in place
+	_, err = st.ReadFile("profile/old_512.png")
+	require.NoError(t, err)
+
+	gc.DryRun = false
+	report, err = gc.Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, len(want))
+	require.Empty(t, report.Errors)
+	for path := range want {
+		_, err := st.ReadFile(path)
+		require.ErrorIs(t, err, fs.ErrNotExist, path)
+		require.ErrorIs(t, db.Unscoped().Where("path = ?", path).First(&models.Upload{}).Error, gorm.ErrRecordNotFound, path)
+	}
+	var remaining []models.ResumableUpload
+	require.NoError(t, db.Find(&remaining).Error)
+	require.Len(t, remaining, 1)
+	require.Equal(t, "receiving", remaining[0].UUID)
+	for _, path := range []string{"profile/new_512.png", "profile/new_64.png", "docs/report.pdf", "profile/in_progress.png", "tus/receiving/00000000000000000000", "quarantine/flagged", "profile/legacy.png"} {
+		_, err := st.ReadFile(path)
+		require.NoError(t, err, path)
+	}
+
+	// Nothing left to collect
+	report, err = gc.Run(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, report.Orphans)
+}
+
+func TestGC_EmptyStorage(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Upload{}, &models.UploadShare{}, &models.ResumableUpload{}, &models.ResumableChunk{}))
+	gc := GC{DB: db, Storer: storage.OsStorer{Path: filepath.Join(t.TempDir(), "missing")}}
+	report, err := gc.Run(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, report.Scanned)
+}
+
+func TestGC_StartWaitsAnInterval(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Upload{}, &models.UploadShare{}, &models.ResumableUpload{}, &models.ResumableChunk{}))
+	st := &storage.MemStorer{}
+	require.NoError(t, st.WriteFile("docs/orphan.txt", []byte("orphan")))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	gc := GC{DB: db, Storer: st, Now: func() time.Time { return time.Now().Add(time.Hour) }}
+	go func() {
+		gc.Start(ctx, time.Hour)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	_, err = st.ReadFile("docs/orphan.txt")
+	require.NoError(t, err)
+	// A run would have removed it
+	report, err := gc.Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 1)
+}
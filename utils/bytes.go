@@ -0,0 +1,23 @@
+package utils
+
+import "fmt"
+
+// FormatBytes formats a size for people, e.g. 5MB. Like the rest of the app
+// a kilobyte is 1024 bytes.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	value := float64(n) / float64(div)
+	suffix := "KMGTP"[exp : exp+1]
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d%sB", int64(value), suffix)
+	}
+	return fmt.Sprintf("%.1f%sB", value, suffix)
+}
@@ -0,0 +1,27 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/nuric/go-web-app-template/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1KB"},
+		{1536, "1.5KB"},
+		{5 * 1024 * 1024, "5MB"},
+		{100 * 1024 * 1024, "100MB"},
+		{1024 * 1024 * 1024, "1GB"},
+		{3 * 1024 * 1024 * 1024 * 1024 / 2, "1.5TB"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, utils.FormatBytes(tt.n), tt.n)
+	}
+}
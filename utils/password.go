@@ -13,6 +13,12 @@ func HumanFriendlyToken() string {
 	return rand.Text()[:8] // Generate a human-friendly token of 8 characters
 }
 
+// LinkToken is used for tokens embedded in links which the user never types,
+// so we can afford the full 130 bits of randomness.
+func LinkToken() string {
+	return rand.Text()
+}
+
 // https://thecopenhagenbook.com/password-authentication
 
 func HashPassword(password string) string {